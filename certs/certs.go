@@ -0,0 +1,206 @@
+// Package certs keeps the TLS certificates of the listener and of the
+// clients connecting to the other nodes, reloading them when the files
+// change.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/boiler/ciri/config"
+)
+
+type Certs struct {
+	cfg *config.ConfigTLS
+
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	ca       *x509.CertPool
+	modTime  time.Time // latest modification of the files
+}
+
+// New loads the files of cfg, the certificate and key are required.
+func New(cfg *config.ConfigTLS) (*Certs, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("tls: cert_file and key_file required")
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return nil, fmt.Errorf("tls: require_client_cert needs client_ca_file")
+	}
+	c := &Certs{cfg: cfg}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again. On error the loaded certificates are kept.
+func (c *Certs) Reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls: %s", err)
+	}
+	clientCA, err := loadPool(c.cfg.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	ca, err := loadPool(c.cfg.CAFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.cert, c.clientCA, c.ca, c.modTime = &cert, clientCA, ca, modTime
+	c.mutex.Unlock()
+	log.Printf("tls: certificates loaded from %s", c.cfg.CertFile)
+	return nil
+}
+
+// Watch reloads the files when they change, until done is closed.
+func (c *Certs) Watch(done chan struct{}) {
+	interval := time.Duration(c.cfg.ReloadInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		modTime, err := c.filesModTime()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		c.mutex.Lock()
+		changed := modTime.After(c.modTime)
+		c.mutex.Unlock()
+		if !changed {
+			continue
+		}
+		if err := c.Reload(); err != nil {
+			log.Printf("tls: reload failed: %s", err)
+		}
+	}
+}
+
+func (c *Certs) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.cfg.CertFile, c.cfg.KeyFile, c.cfg.ClientCAFile, c.cfg.CAFile} {
+		if path == "" {
+			continue
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			return latest, fmt.Errorf("tls: %s", err)
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// loadPool returns nil for an empty path, so that the system roots are used.
+func loadPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// ServerConfig returns the listener config, every handshake uses the latest
+// loaded files.
+func (c *Certs) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			return c.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if c.clientCA != nil {
+				cfg.ClientCAs = c.clientCA
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				if c.cfg.RequireClientCert {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// Client returns the http client for the other nodes, it presents the node
+// certificate when they ask for a client certificate.
+func (c *Certs) Client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			return c.cert, nil
+		},
+		// the roots may be reloaded, so the chain is verified here
+		InsecureSkipVerify: true,
+		VerifyConnection:   c.verifyServer,
+	}
+	return &http.Client{Transport: transport}
+}
+
+func (c *Certs) verifyServer(cs tls.ConnectionState) error {
+	c.mutex.Lock()
+	roots := c.ca
+	c.mutex.Unlock()
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("tls: no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// ClientName returns the common name of the verified client certificate of
+// the connection, empty if there is none.
+func ClientName(cs *tls.ConnectionState) string {
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return ""
+	}
+	return cs.VerifiedChains[0][0].Subject.CommonName
+}
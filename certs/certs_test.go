@@ -0,0 +1,303 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boiler/ciri/config"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+var serial int64 = 1
+
+// issue returns the PEM certificate and key for the common name, valid for
+// 127.0.0.1 as a server and as a client.
+func (ca *testCA) issue(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setup writes the CA and the node certificate of name into a temp dir and
+// returns the config using them.
+func setup(t *testing.T, ca *testCA, name string) *config.ConfigTLS {
+	dir := t.TempDir()
+	cfg := &config.ConfigTLS{
+		CertFile:     filepath.Join(dir, "node.crt"),
+		KeyFile:      filepath.Join(dir, "node.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+		CAFile:       filepath.Join(dir, "ca.crt"),
+	}
+	cert, key := ca.issue(t, name)
+	writeFile(t, cfg.CertFile, cert)
+	writeFile(t, cfg.KeyFile, key)
+	writeFile(t, cfg.ClientCAFile, ca.pem)
+	return cfg
+}
+
+// serve starts a server answering with the client certificate name.
+func serve(t *testing.T, c *Certs) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, ClientName(r.TLS))
+	}))
+	srv.TLS = c.ServerConfig()
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// client returns a client trusting ca, presenting the certificate if given.
+// The certificate is sent even if the server asks for another issuer, so that
+// the server has to reject it.
+func client(t *testing.T, ca *testCA, cert []byte, key []byte) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	tlsConfig := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &pair, nil
+		}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+}
+
+func get(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCA(t, "ca")
+	c, err := New(setup(t, ca, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, c)
+
+	cert, key := ca.issue(t, "worker-1")
+	name, err := get(client(t, ca, cert, key), srv.URL)
+	if err != nil || name != "worker-1" {
+		t.Errorf("client certificate name %q, %v; expected worker-1", name, err)
+	}
+	// the node client verifies the server with ca_file and presents the node
+	// certificate
+	name, err = get(c.Client(), srv.URL)
+	if err != nil || name != "node" {
+		t.Errorf("node client name %q, %v; expected node", name, err)
+	}
+	// the client certificate is optional without require_client_cert
+	name, err = get(client(t, ca, nil, nil), srv.URL)
+	if err != nil || name != "" {
+		t.Errorf("name without a client certificate %q, %v", name, err)
+	}
+	// certificates of another CA are not verified
+	other := newCA(t, "other")
+	cert, key = other.issue(t, "worker-1")
+	if name, err := get(client(t, ca, cert, key), srv.URL); err == nil {
+		t.Errorf("certificate of another CA accepted as %q", name)
+	}
+}
+
+func TestNodeClientVerifiesServer(t *testing.T) {
+	ca := newCA(t, "ca")
+	other := newCA(t, "other")
+	c, err := New(setup(t, ca, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rogue, err := New(setup(t, other, "node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, rogue)
+	if _, err := get(c.Client(), srv.URL); err == nil {
+		t.Error("server of another CA accepted")
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	ca := newCA(t, "ca")
+	cfg := setup(t, ca, "node")
+	cfg.RequireClientCert = true
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, c)
+
+	if name, err := get(client(t, ca, nil, nil), srv.URL); err == nil {
+		t.Errorf("client without a certificate accepted as %q", name)
+	}
+	other := newCA(t, "other")
+	cert, key := other.issue(t, "worker-1")
+	if name, err := get(client(t, ca, cert, key), srv.URL); err == nil {
+		t.Errorf("unverified client certificate accepted as %q", name)
+	}
+	cert, key = ca.issue(t, "worker-1")
+	if name, err := get(client(t, ca, cert, key), srv.URL); err != nil || name != "worker-1" {
+		t.Errorf("client certificate name %q, %v; expected worker-1", name, err)
+	}
+
+	cfg.ClientCAFile = ""
+	if _, err := New(cfg); err == nil {
+		t.Error("require_client_cert accepted without client_ca_file")
+	}
+}
+
+// serverName returns the common name of the certificate the server presents.
+func serverName(t *testing.T, ca *testCA, url string) string {
+	t.Helper()
+	resp, err := client(t, ca, nil, nil).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// replace writes a new node certificate, with the modification time moved
+// ahead so that it differs from the loaded one on coarse file systems.
+func replace(t *testing.T, ca *testCA, cfg *config.ConfigTLS, name string) {
+	cert, key := ca.issue(t, name)
+	writeFile(t, cfg.CertFile, cert)
+	writeFile(t, cfg.KeyFile, key)
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{cfg.CertFile, cfg.KeyFile} {
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	ca := newCA(t, "ca")
+	cfg := setup(t, ca, "node")
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, c)
+	if name := serverName(t, ca, srv.URL); name != "node" {
+		t.Fatalf("server certificate %q, expected node", name)
+	}
+
+	replace(t, ca, cfg, "node-2")
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := serverName(t, ca, srv.URL); name != "node-2" {
+		t.Errorf("server certificate %q after reload, expected node-2", name)
+	}
+
+	// a broken file keeps the loaded certificate
+	writeFile(t, cfg.KeyFile, []byte("broken"))
+	if err := c.Reload(); err == nil {
+		t.Error("reload of a broken key succeeded")
+	}
+	if name := serverName(t, ca, srv.URL); name != "node-2" {
+		t.Errorf("server certificate %q after failed reload, expected node-2", name)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ca := newCA(t, "ca")
+	cfg := setup(t, ca, "node")
+	cfg.ReloadInterval = 1
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := serve(t, c)
+	done := make(chan struct{})
+	defer close(done)
+	go c.Watch(done)
+
+	replace(t, ca, cfg, "node-2")
+	deadline := time.Now().Add(5 * time.Second)
+	for serverName(t, ca, srv.URL) != "node-2" {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced certificate not picked up by Watch")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -11,12 +11,21 @@ import (
 	"syscall"
 
 	"github.com/boiler/ciri/config"
+	"github.com/boiler/ciri/ctl"
 	"github.com/boiler/ciri/handler"
 	"github.com/boiler/ciri/metrics"
+	"github.com/boiler/ciri/snaptool"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctl.Main(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		os.Exit(snaptool.Main(os.Args[2:]))
+	}
+
 	log.Print("start")
 	cfg := config.NewConfig()
 	metrics.Init(cfg)
@@ -42,6 +51,21 @@ func main() {
 		Handler: httpMux,
 	}
 	httpServer.SetKeepAlivesEnabled(false)
+	if tlsConfig := h.TLSConfig(); tlsConfig != nil {
+		hupc := make(chan os.Signal, 1)
+		signal.Notify(hupc, syscall.SIGHUP)
+		go func() {
+			for range hupc {
+				h.ReloadCerts()
+			}
+		}()
+		httpServer.TLSConfig = tlsConfig
+		log.Printf("https server starts listening on %s", cfg.Listen)
+		if err := httpServer.ListenAndServeTLS("", ""); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	log.Printf("http server starts listening on %s", cfg.Listen)
 	if err := httpServer.ListenAndServe(); err != nil {
 		log.Fatal(err)
@@ -0,0 +1,311 @@
+// Package client is a Go client for the ciri HTTP API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boiler/ciri/db"
+)
+
+type (
+	Task     = db.Task
+	Progress = db.Progress
+	Filter   = db.Filter
+)
+
+// Error is returned for non-2xx responses, Errors and Code hold the
+// {"errors":[...],"code":"..."} body.
+type Error struct {
+	StatusCode int
+	Errors     []string
+	Code       string
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("ciri: http status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("ciri: %s", strings.Join(e.Errors, "; "))
+}
+
+type Client struct {
+	Addr       string // base url, e.g. http://localhost:8080
+	Token      string // sent as x-auth-token
+	HTTPClient *http.Client
+	MaxRetries int           // retries while the server is in safemode
+	RetryDelay time.Duration // delay between the retries
+}
+
+func New(addr string, token string) *Client {
+	return &Client{
+		Addr:       strings.TrimRight(addr, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 10,
+		RetryDelay: time.Second,
+	}
+}
+
+// do sends the request and decodes the json response into res, if not nil.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, res interface{}) error {
+	resp, err := c.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
+
+// send returns a successful response, its body must be closed.
+func (c *Client) send(ctx context.Context, method string, path string, body interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.Addr+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("content-type", "application/json")
+		}
+		if c.Token != "" {
+			req.Header.Set("x-auth-token", c.Token)
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		json.Unmarshal(respBody, apiErr)
+		// only the safemode refusal is known not to be applied, other 503s
+		// may come from a proxy after the change was made
+		if apiErr.Code != "safemode" || attempt >= c.MaxRetries {
+			return nil, apiErr
+		}
+		select {
+		case <-time.After(c.RetryDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Insert inserts the task and returns its id.
+func (c *Client) Insert(ctx context.Context, t *Task) (string, error) {
+	var res struct {
+		Id string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/task/insert", t, &res); err != nil {
+		return "", err
+	}
+	t.Id = res.Id
+	return res.Id, nil
+}
+
+// InsertBatch inserts the tasks in one transaction as members of a group and
+// returns the group id. An empty group creates a new one.
+func (c *Client) InsertBatch(ctx context.Context, group string, tasks []*Task, onComplete *db.GroupAction) (string, error) {
+	req := struct {
+		Id         string          `json:"id,omitempty"`
+		Tasks      []*Task         `json:"tasks"`
+		OnComplete *db.GroupAction `json:"on_complete,omitempty"`
+	}{group, tasks, onComplete}
+	var res struct {
+		Id    string   `json:"id"`
+		Tasks []string `json:"tasks"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/group/insert", req, &res); err != nil {
+		return "", err
+	}
+	for i, id := range res.Tasks {
+		if i < len(tasks) {
+			tasks[i].Id = id
+		}
+	}
+	return res.Id, nil
+}
+
+// Acquire returns the task held by the worker or a new one, nil if the queue
+// is empty.
+func (c *Client) Acquire(ctx context.Context, worker string) (*Task, error) {
+	var res struct {
+		Task *Task `json:"task"`
+	}
+	req := map[string]string{"worker": worker}
+	if err := c.do(ctx, http.MethodPost, "/v1/task/acquire", req, &res); err != nil {
+		return nil, err
+	}
+	return res.Task, nil
+}
+
+type updateRequest struct {
+	Id       string          `json:"id"`
+	Worker   string          `json:"worker"`
+	Status   string          `json:"status"`
+	Error    bool            `json:"error,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Progress *Progress       `json:"progress,omitempty"`
+}
+
+type updateResponse struct {
+	CancelRequested bool `json:"cancel_requested"`
+}
+
+// Update reports the task progress. It returns true when the task
+// cancellation was requested and the worker should stop.
+func (c *Client) Update(ctx context.Context, id string, worker string, status string, progress *Progress) (bool, error) {
+	var res updateResponse
+	req := &updateRequest{Id: id, Worker: worker, Status: status, Progress: progress}
+	err := c.do(ctx, http.MethodPost, "/v1/task/update", req, &res)
+	return res.CancelRequested, err
+}
+
+// Done finishes the task, as ERROR if failed is set.
+func (c *Client) Done(ctx context.Context, id string, worker string, status string, result json.RawMessage, failed bool) error {
+	req := &updateRequest{Id: id, Worker: worker, Status: status, Result: result, Error: failed}
+	return c.do(ctx, http.MethodPost, "/v1/task/done", req, nil)
+}
+
+// Refuse returns the task to the queue, or cancels it if its cancellation
+// was requested.
+func (c *Client) Refuse(ctx context.Context, id string, worker string, status string) error {
+	req := &updateRequest{Id: id, Worker: worker, Status: status}
+	return c.do(ctx, http.MethodPost, "/v1/task/refuse", req, nil)
+}
+
+// Cancel cancels the task, or requests its cancellation if acquired.
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/v1/task/cancel", map[string]string{"id": id}, nil)
+}
+
+func (c *Client) Delete(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, "/v1/task/delete", map[string]string{"id": id}, nil)
+}
+
+// Get returns the task by id, nil if not found.
+func (c *Client) Get(ctx context.Context, id string) (*Task, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/v1/task/get/?id="+url.QueryEscape(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 64<<20)
+	if !scanner.Scan() {
+		return nil, scanner.Err()
+	}
+	t := &Task{}
+	if err := json.Unmarshal(scanner.Bytes(), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+type ListOptions struct {
+	Filter
+	Order  string // added, updated or priority, "-" prefix for descending
+	Limit  int
+	Cursor string
+}
+
+// List returns a page of tasks matching the options and the cursor of the
+// next page, empty on the last one.
+func (c *Client) List(ctx context.Context, opts *ListOptions) ([]*Task, string, error) {
+	q := opts.Filter.Values()
+	if opts.Order != "" {
+		q.Set("order", opts.Order)
+	}
+	if opts.Limit > 0 {
+		q.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Cursor != "" {
+		q.Set("cursor", opts.Cursor)
+	}
+	var res struct {
+		Tasks  []*Task `json:"tasks"`
+		Cursor string  `json:"cursor"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/task/query?"+q.Encode(), nil, &res); err != nil {
+		return nil, "", err
+	}
+	return res.Tasks, res.Cursor, nil
+}
+
+// Requeue moves a finished or stuck task back to NEW. A nil priority keeps
+// the current one.
+func (c *Client) Requeue(ctx context.Context, id string, priority *int, delay time.Duration) (*Task, error) {
+	req := struct {
+		Id       string `json:"id"`
+		Priority *int   `json:"priority,omitempty"`
+		Delay    uint64 `json:"delay,omitempty"`
+	}{id, priority, uint64(delay / time.Second)}
+	var res struct {
+		Task *Task `json:"task"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/task/requeue", req, &res); err != nil {
+		return nil, err
+	}
+	return res.Task, nil
+}
+
+// Stats returns task counts matching the filter grouped by any of pool,
+// sticker, state and priority.
+func (c *Client) Stats(ctx context.Context, f *Filter, groupBy []string) (*db.Stats, error) {
+	q := f.Values()
+	if len(groupBy) > 0 {
+		q.Set("group_by", strings.Join(groupBy, ","))
+	}
+	stats := &db.Stats{}
+	if err := c.do(ctx, http.MethodGet, "/v1/stats?"+q.Encode(), nil, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// PausePool stops or resumes acquiring of the pool tasks.
+func (c *Client) PausePool(ctx context.Context, pool string, paused bool) error {
+	req := struct {
+		Pool   string `json:"pool"`
+		Paused bool   `json:"paused"`
+	}{pool, paused}
+	return c.do(ctx, http.MethodPost, "/v1/pool/pause", req, nil)
+}
+
+func (c *Client) Pools(ctx context.Context) ([]*db.Pool, error) {
+	var res struct {
+		Pools []*db.Pool `json:"pools"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/pool/list", nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Pools, nil
+}
+
+// Snapshot makes the server write its snapshot.
+func (c *Client) Snapshot(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/v1/admin/snapshot", struct{}{}, nil)
+}
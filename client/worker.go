@@ -0,0 +1,148 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Job is the task being run by a Worker.
+type Job struct {
+	Task *Task
+
+	mutex    sync.Mutex
+	status   string
+	progress *Progress
+}
+
+// Update sets the status and progress reported with the next heartbeat.
+func (j *Job) Update(status string, progress *Progress) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.status = status
+	j.progress = progress
+}
+
+func (j *Job) pending() (string, *Progress) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	progress := j.progress
+	j.progress = nil
+	return j.status, progress
+}
+
+// ErrRefuse returned by a HandlerFunc puts the task back to the queue.
+var ErrRefuse = errors.New("task refused")
+
+// HandlerFunc runs the task. Its context is cancelled when the task
+// cancellation is requested or the worker stops. A returned error finishes
+// the task as ERROR with the error text as status.
+type HandlerFunc func(ctx context.Context, job *Job) (json.RawMessage, error)
+
+type Worker struct {
+	Client       *Client
+	Name         string
+	Handler      HandlerFunc
+	PollInterval time.Duration // delay before the next acquire when the queue is empty
+	Heartbeat    time.Duration // interval of progress updates
+}
+
+func NewWorker(c *Client, name string, handler HandlerFunc) *Worker {
+	return &Worker{
+		Client:       c,
+		Name:         name,
+		Handler:      handler,
+		PollInterval: 5 * time.Second,
+		Heartbeat:    10 * time.Second,
+	}
+}
+
+// Run acquires and runs tasks one by one until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) error {
+	for {
+		task, err := w.Client.Acquire(ctx, w.Name)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("ciri worker %s: acquire: %s", w.Name, err)
+		}
+		if task == nil {
+			select {
+			case <-time.After(w.PollInterval):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err := w.run(ctx, task); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("ciri worker %s: task %s: %s", w.Name, task.Id, err)
+		}
+	}
+}
+
+func (w *Worker) run(ctx context.Context, task *Task) error {
+	job := &Job{Task: task}
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		result json.RawMessage
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := w.Handler(jobCtx, job)
+		done <- outcome{result, err}
+	}()
+
+	heartbeat := time.NewTicker(w.Heartbeat)
+	defer heartbeat.Stop()
+	cancelled := task.CancelRequested
+	if cancelled {
+		cancel()
+	}
+	// mark the task as in work right away
+	if cancelRequested, err := w.Client.Update(ctx, task.Id, w.Name, "", nil); err == nil && cancelRequested {
+		cancelled = true
+		cancel()
+	}
+	for {
+		select {
+		case <-heartbeat.C:
+			status, progress := job.pending()
+			cancelRequested, err := w.Client.Update(ctx, task.Id, w.Name, status, progress)
+			if err != nil {
+				log.Printf("ciri worker %s: task %s: heartbeat: %s", w.Name, task.Id, err)
+			} else if cancelRequested && !cancelled {
+				cancelled = true
+				cancel()
+			}
+		case o := <-done:
+			// the task is reported even if the worker is stopping
+			reportCtx, reportCancel := context.WithTimeout(context.Background(), time.Minute)
+			defer reportCancel()
+			status, progress := job.pending()
+			if progress != nil {
+				w.Client.Update(reportCtx, task.Id, w.Name, status, progress)
+			}
+			switch {
+			case cancelled || o.err == ErrRefuse:
+				return w.Client.Refuse(reportCtx, task.Id, w.Name, status)
+			case ctx.Err() != nil:
+				// the handler usually fails with ctx.Err() on shutdown, the
+				// task goes back to the queue instead of being an error
+				return w.Client.Refuse(reportCtx, task.Id, w.Name, "worker stopped")
+			case o.err != nil:
+				return w.Client.Done(reportCtx, task.Id, w.Name, o.err.Error(), o.result, true)
+			}
+			return w.Client.Done(reportCtx, task.Id, w.Name, status, o.result, false)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+// Package cluster runs ciri as a raft cluster: the changes of every write
+// transaction are committed through the raft log before they are applied,
+// so that any member can take over as the leader.
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boiler/ciri/config"
+	"github.com/boiler/ciri/db"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// entry is a raft log entry, the changes of one write transaction.
+type entry struct {
+	Node     string       `json:"node"`
+	Proposal uint64       `json:"proposal"`
+	Changes  []*db.Change `json:"changes"`
+	Events   []*db.Event  `json:"events,omitempty"`
+}
+
+type Cluster struct {
+	cfg       *config.ConfigCluster
+	authToken string
+	client    *http.Client
+	raftAddr  string // advertised raft address
+	db        *db.DB
+	raft      *raft.Raft
+	store     *raftboltdb.BoltStore
+	timeout   time.Duration
+
+	mutex    sync.Mutex
+	ready    bool   // leader with all previous entries applied
+	proposal uint64 // id of the entry being applied by this node
+}
+
+type Server struct {
+	Id       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	Addr     string `json:"addr,omitempty"`
+	Voter    bool   `json:"voter"`
+	Leader   bool   `json:"leader"`
+}
+
+type Status struct {
+	Node         string    `json:"node"`
+	State        string    `json:"state"`
+	Leader       string    `json:"leader,omitempty"`
+	LeaderAddr   string    `json:"leader_addr,omitempty"`
+	Servers      []*Server `json:"servers"`
+	LastIndex    uint64    `json:"last_index"`
+	AppliedIndex uint64    `json:"applied_index"`
+}
+
+// New starts the raft node and makes mdb commit through it. The node
+// restores its state from the raft snapshot and log in data_dir, client is
+// used to join the other members.
+func New(cfg *config.Config, mdb *db.DB, client *http.Client) (*Cluster, error) {
+	cc := cfg.Cluster
+	if cc.NodeId == "" || cc.Bind == "" || cc.DataDir == "" {
+		return nil, fmt.Errorf("cluster: node_id, bind and data_dir required")
+	}
+	if cc.Advertise == "" {
+		return nil, fmt.Errorf("cluster: advertise required")
+	}
+	raftAddr, err := advertisedAddr(cc)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		cfg:       cc,
+		authToken: cfg.NodeToken(),
+		client:    client,
+		raftAddr:  raftAddr,
+		db:        mdb,
+		timeout:   10 * time.Second,
+	}
+	if cc.ApplyTimeout > 0 {
+		c.timeout = time.Duration(cc.ApplyTimeout) * time.Second
+	}
+	if err := os.MkdirAll(cc.DataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	rc := raft.DefaultConfig()
+	rc.LocalID = raft.ServerID(cc.NodeId)
+	rc.LogLevel = "WARN"
+	addr, err := net.ResolveTCPAddr("tcp", raftAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(cc.Bind, addr, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(cc.DataDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	c.store, err = raftboltdb.NewBoltStore(filepath.Join(cc.DataDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+	if cc.Bootstrap {
+		existing, err := raft.HasExistingState(c.store, c.store, snapshots)
+		if err != nil {
+			return nil, err
+		}
+		if !existing {
+			log.Printf("cluster: bootstrapping node %s", cc.NodeId)
+			err := raft.BootstrapCluster(rc, c.store, c.store, snapshots, transport, raft.Configuration{
+				Servers: []raft.Server{{ID: rc.LocalID, Address: transport.LocalAddr()}},
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.raft, err = raft.NewRaft(rc, (*fsm)(c), c.store, c.store, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+	mdb.SetReplicator(c)
+	go c.watchLeadership()
+	if cc.Join != "" {
+		go c.join()
+	}
+	return c, nil
+}
+
+// advertisedAddr returns the raft address for the other members, bind
+// unless raft_advertise is set. A bind address without a host, e.g.
+// 0.0.0.0:7000, can't be reached by them.
+func advertisedAddr(cc *config.ConfigCluster) (string, error) {
+	addr := cc.RaftAdvertise
+	if addr == "" {
+		addr = cc.Bind
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("cluster: raft address %s: %s", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if cc.RaftAdvertise != "" {
+			return "", fmt.Errorf("cluster: raft_advertise %s has no host", addr)
+		}
+		return "", fmt.Errorf("cluster: raft_advertise required, bind %s has no host", addr)
+	}
+	return addr, nil
+}
+
+func (c *Cluster) Shutdown() error {
+	if err := c.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	return c.store.Close()
+}
+
+// Apply commits the changes through the raft log, it is called by the db
+// writers holding the db lock, so there is a single proposal at a time.
+func (c *Cluster) Apply(changes []*db.Change, events []*db.Event) error {
+	c.mutex.Lock()
+	if !c.ready {
+		c.mutex.Unlock()
+		return fmt.Errorf("not the cluster leader")
+	}
+	c.proposal++
+	e := &entry{Node: c.cfg.NodeId, Proposal: c.proposal, Changes: changes, Events: events}
+	c.mutex.Unlock()
+
+	data, err := json.Marshal(e)
+	if err == nil {
+		data, err = c.db.Keys().Seal(data)
+	}
+	if err != nil {
+		return err
+	}
+	f := c.raft.Apply(data, c.timeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err, ok := f.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// watchLeadership lets the node take writes once it is the leader and has
+// applied the entries of the previous terms.
+func (c *Cluster) watchLeadership() {
+	for leader := range c.raft.LeaderCh() {
+		c.mutex.Lock()
+		c.ready = false
+		c.mutex.Unlock()
+		if !leader {
+			log.Printf("cluster: node %s lost leadership", c.cfg.NodeId)
+			continue
+		}
+		if err := c.raft.Barrier(c.timeout).Error(); err != nil {
+			log.Printf("cluster: barrier: %s", err)
+			continue
+		}
+		c.mutex.Lock()
+		c.ready = true
+		c.mutex.Unlock()
+		log.Printf("cluster: node %s is the leader", c.cfg.NodeId)
+
+		member, err := c.db.GetMember(c.cfg.NodeId)
+		if err == nil && (member == nil || member.Addr != c.cfg.Advertise || member.RaftAddr != c.raftAddr) {
+			err = c.db.SetMember(&db.Member{Id: c.cfg.NodeId, RaftAddr: c.raftAddr, Addr: c.cfg.Advertise})
+		}
+		if err != nil {
+			log.Printf("cluster: member: %s", err)
+		}
+	}
+}
+
+// join asks the member at the join url to add this node, until it is done.
+func (c *Cluster) join() {
+	body, _ := json.Marshal(&db.Member{Id: c.cfg.NodeId, RaftAddr: c.raftAddr, Addr: c.cfg.Advertise})
+	url := strings.TrimRight(c.cfg.Join, "/") + "/v1/cluster/join"
+	for {
+		if c.isMember() {
+			return
+		}
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("cluster: join: %s", err)
+			return
+		}
+		req.Header.Set("content-type", "application/json")
+		if c.authToken != "" {
+			req.Header.Set("x-auth-token", c.authToken)
+		}
+		resp, err := c.client.Do(req)
+		if err == nil {
+			respBody, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Printf("cluster: joined via %s", c.cfg.Join)
+				return
+			}
+			err = fmt.Errorf("http status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+		}
+		log.Printf("cluster: join: %s", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (c *Cluster) isMember() bool {
+	f := c.raft.GetConfiguration()
+	if f.Error() != nil {
+		return false
+	}
+	for _, s := range f.Configuration().Servers {
+		if s.ID == raft.ServerID(c.cfg.NodeId) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLeader reports whether the node takes writes.
+func (c *Cluster) IsLeader() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ready && c.raft.State() == raft.Leader
+}
+
+// LeaderAddr returns the http url of the leader, empty if unknown.
+func (c *Cluster) LeaderAddr() string {
+	_, id := c.raft.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	m, err := c.db.GetMember(string(id))
+	if err != nil || m == nil {
+		return ""
+	}
+	return m.Addr
+}
+
+// Join adds the member as a voter, called on the leader.
+func (c *Cluster) Join(m *db.Member) error {
+	if m.Id == "" || m.RaftAddr == "" || m.Addr == "" {
+		return fmt.Errorf("id, raft_addr and addr required")
+	}
+	f := c.raft.AddVoter(raft.ServerID(m.Id), raft.ServerAddress(m.RaftAddr), 0, c.timeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	return c.db.SetMember(m)
+}
+
+// Remove drops the member from the cluster, called on the leader.
+func (c *Cluster) Remove(id string) error {
+	if id == "" {
+		return fmt.Errorf("id required")
+	}
+	f := c.raft.RemoveServer(raft.ServerID(id), 0, c.timeout)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	return c.db.DeleteMember(id)
+}
+
+func (c *Cluster) Status() (*Status, error) {
+	leaderAddr, leaderId := c.raft.LeaderWithID()
+	status := &Status{
+		Node:         c.cfg.NodeId,
+		State:        c.raft.State().String(),
+		Leader:       string(leaderId),
+		LeaderAddr:   c.LeaderAddr(),
+		Servers:      []*Server{},
+		LastIndex:    c.raft.LastIndex(),
+		AppliedIndex: c.raft.AppliedIndex(),
+	}
+	f := c.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+	for _, s := range f.Configuration().Servers {
+		server := &Server{
+			Id:       string(s.ID),
+			RaftAddr: string(s.Address),
+			Voter:    s.Suffrage == raft.Voter,
+			Leader:   s.Address == leaderAddr,
+		}
+		if m, err := c.db.GetMember(server.Id); err == nil && m != nil {
+			server.Addr = m.Addr
+		}
+		status.Servers = append(status.Servers, server)
+	}
+	return status, nil
+}
+
+// fsm applies the committed entries to the db.
+type fsm Cluster
+
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	data, err := f.db.Keys().Open(l.Data)
+	if err != nil {
+		return err
+	}
+	e := &entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return err
+	}
+	// the writer of this node updates the metrics and publishes the events
+	// of its own proposal
+	f.mutex.Lock()
+	own := e.Node == f.cfg.NodeId && e.Proposal == f.proposal
+	f.mutex.Unlock()
+	return f.db.ApplyCommitted(e.Changes, e.Events, !own)
+}
+
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &fsmSnapshot{f.db.SnapshotEncoder(), f.db.Keys()}, nil
+}
+
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	r, err := f.db.Keys().Reader(bufio.NewReader(rc))
+	if err != nil {
+		return err
+	}
+	_, err = f.db.LoadReplica(r)
+	return err
+}
+
+// fsmSnapshot is the db snapshot in the format of WriteSnapshot.
+type fsmSnapshot struct {
+	encode func(io.Writer) (*db.SnapshotInfo, error)
+	keys   *db.Keys
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	ew, err := s.keys.Writer(w)
+	if err == nil {
+		_, err = s.encode(ew)
+	}
+	if err == nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
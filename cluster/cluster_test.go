@@ -0,0 +1,28 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/boiler/ciri/config"
+)
+
+func TestAdvertisedAddr(t *testing.T) {
+	for _, tc := range []struct {
+		bind, advertise string
+		expected        string // empty for an error
+	}{
+		{"127.0.0.1:7000", "", "127.0.0.1:7000"},
+		{"node1:7000", "", "node1:7000"},
+		{"0.0.0.0:7000", "", ""},
+		{":7000", "", ""},
+		{"[::]:7000", "", ""},
+		{"0.0.0.0:7000", "10.0.0.1:7000", "10.0.0.1:7000"},
+		{"0.0.0.0:7000", "0.0.0.0:7000", ""},
+		{"127.0.0.1", "", ""},
+	} {
+		addr, err := advertisedAddr(&config.ConfigCluster{Bind: tc.bind, RaftAdvertise: tc.advertise})
+		if tc.expected == "" && err == nil || addr != tc.expected {
+			t.Errorf("bind %q, raft_advertise %q: %q, %v; expected %q", tc.bind, tc.advertise, addr, err, tc.expected)
+		}
+	}
+}
@@ -12,23 +12,119 @@ import (
 )
 
 type Config struct {
-	Listen             string `toml:"listen"`
-	SnapshotPath       string `toml:"snapshot_path"`
-	AuthToken          string `toml:"auth_token"`
-	DefaultPoolMaxSize int    `toml:"default_pool_max_size"`
-	MetricsPrefix      string `toml:"metrics_prefix"`
-	Pool               map[string]*ConfigPool
+	Listen                   string `toml:"listen"`
+	SnapshotPath             string `toml:"snapshot_path"`
+	AuthToken                string `toml:"auth_token"`
+	DefaultPoolMaxSize       int    `toml:"default_pool_max_size"`
+	DefaultPoolMaxResultSize int    `toml:"default_pool_max_result_size"`
+	MetricsPrefix            string `toml:"metrics_prefix"`
+	StatusHistorySize        int    `toml:"status_history_size"`
+	HistorySize              int    `toml:"history_size"`
+	HistoryRetention         int    `toml:"history_retention"` // seconds to keep history of deleted tasks
+	EventBufferSize          int    `toml:"event_buffer_size"`
+	WebhookTimeout           int    `toml:"webhook_timeout"` // seconds
+	WebhookMaxAttempts       int    `toml:"webhook_max_attempts"`
+	WebhookBackoff           int    `toml:"webhook_backoff"` // seconds before the first retry, doubled on every next one
+	WebhookQueueSize         int    `toml:"webhook_queue_size"`
+	WebhookLogSize           int    `toml:"webhook_log_size"`
+	Follow                   string `toml:"follow"` // leader url, runs as a read-only follower if set
+	ReplicationLogSize       int    `toml:"replication_log_size"`
+	Pool                     map[string]*ConfigPool
+	Webhook                  []*ConfigWebhook
+	Cluster                  *ConfigCluster
+	Token                    []*ConfigToken
+	TLS                      *ConfigTLS
+	Encryption               *ConfigEncryption
+
+	MaxBodySize int64            `toml:"max_body_size"` // bytes, 0 for no limit
+	BodyLimit   map[string]int64 `toml:"body_limit"`    // max_body_size by endpoint path
+	RateLimit   float64          `toml:"rate_limit"`    // requests per second of a token or an ip, 0 for no limit
+	RateBurst   int              `toml:"rate_burst"`
+}
+
+// ConfigEncryption enables AES-256-GCM encryption of the snapshots and of the
+// raft log. Keys are 32 bytes, hex or base64 encoded, read from a file or an
+// environment variable. The old keys only decrypt, so that the snapshots
+// written before a key rotation can be read.
+type ConfigEncryption struct {
+	KeyFile     string   `toml:"key_file"`
+	KeyEnv      string   `toml:"key_env"`
+	OldKeyFiles []string `toml:"old_key_files"`
+	OldKeyEnvs  []string `toml:"old_key_envs"`
 }
+
+// ConfigTLS enables https on the listener. With client_ca_file the client
+// certificates are verified and mapped to tokens by client_cert. The files
+// are read again on SIGHUP and when they change.
+type ConfigTLS struct {
+	CertFile          string `toml:"cert_file"`
+	KeyFile           string `toml:"key_file"`
+	ClientCAFile      string `toml:"client_ca_file"`
+	RequireClientCert bool   `toml:"require_client_cert"`
+	CAFile            string `toml:"ca_file"`         // CA of the other nodes, system roots if empty
+	ReloadInterval    int    `toml:"reload_interval"` // seconds between checks of the files, 60 if 0
+}
+
+// ConfigToken is a named API token. Pools and stickers, if set, limit the
+// tasks the token can see and change. ClientCert is the common name of the
+// client certificates authenticated as the token, instead of or besides the
+// token string. Worker, if set, is the only worker name the token can use.
+type ConfigToken struct {
+	Name       string   `toml:"name"`
+	Token      string   `toml:"token"`
+	Roles      []string `toml:"roles"` // producer, worker, admin
+	Pools      []string `toml:"pools"`
+	Stickers   []string `toml:"stickers"`
+	ClientCert string   `toml:"client_cert"`
+	Worker     string   `toml:"worker"`
+	RateLimit  float64  `toml:"rate_limit"` // rate_limit and rate_burst of the token, global ones if 0
+	RateBurst  int      `toml:"rate_burst"`
+}
+type ConfigWebhook struct {
+	Url      string   `toml:"url"`
+	Events   []string `toml:"events"` // event types, all if empty
+	Pools    []string `toml:"pools"`
+	Stickers []string `toml:"stickers"`
+	Secret   string   `toml:"secret"` // HMAC-SHA256 key for the x-ciri-signature header
+}
+
+// ConfigCluster enables the clustered mode, where all changes go through
+// the raft log. A bind address without a host, e.g. 0.0.0.0:7000, needs
+// raft_advertise.
+type ConfigCluster struct {
+	NodeId        string `toml:"node_id"`
+	Bind          string `toml:"bind"`           // raft transport address
+	RaftAdvertise string `toml:"raft_advertise"` // raft address for the other members, bind if empty
+	Advertise     string `toml:"advertise"`      // http url of the node for the other members
+	DataDir       string `toml:"data_dir"`
+	Bootstrap     bool   `toml:"bootstrap"`     // form a new cluster of this node
+	Join          string `toml:"join"`          // http url of a member to join
+	ApplyTimeout  int    `toml:"apply_timeout"` // seconds
+}
+
 type ConfigPool struct {
-	MaxSize int `toml:"max_size"`
+	MaxSize       int `toml:"max_size"`
+	MaxResultSize int `toml:"max_result_size"`
 }
 
 func NewConfig() *Config {
 	myName := filepath.Base(os.Args[0])
 	cfg := &Config{
-		Listen:             ":8080",
-		DefaultPoolMaxSize: 8,
-		MetricsPrefix:      myName,
+		Listen:                   ":8080",
+		DefaultPoolMaxSize:       8,
+		DefaultPoolMaxResultSize: 65536,
+		MetricsPrefix:            myName,
+		StatusHistorySize:        20,
+		HistorySize:              50,
+		HistoryRetention:         86400,
+		EventBufferSize:          1024,
+		WebhookTimeout:           10,
+		WebhookMaxAttempts:       5,
+		WebhookBackoff:           1,
+		WebhookQueueSize:         1000,
+		WebhookLogSize:           100,
+		ReplicationLogSize:       10000,
+		MaxBodySize:              16 << 20,
 	}
 	path := os.Getenv(strings.ToUpper(myName) + "_CONFIG_PATH")
 	if path == "" {
@@ -52,9 +148,44 @@ func NewConfig() *Config {
 	return cfg
 }
 
+// NodeToken returns the token sent to the other nodes of a cluster or to
+// the replication leader: auth_token or the first unscoped admin token.
+func (cfg *Config) NodeToken() string {
+	if cfg.AuthToken != "" {
+		return cfg.AuthToken
+	}
+	for _, t := range cfg.Token {
+		if t.Token == "" || len(t.Pools) > 0 || len(t.Stickers) > 0 {
+			continue
+		}
+		for _, role := range t.Roles {
+			if role == "admin" {
+				return t.Token
+			}
+		}
+	}
+	return ""
+}
+
+// GetMaxBodySize returns the request body limit of the endpoint, the path
+// is the route one with the {name} segments, e.g. /v2/tasks/{id}/done.
+func (cfg *Config) GetMaxBodySize(path string) int64 {
+	if v, ok := cfg.BodyLimit[path]; ok {
+		return v
+	}
+	return cfg.MaxBodySize
+}
+
 func (cfg *Config) GetPoolMaxSize(pool string) int {
 	if p, ok := cfg.Pool[pool]; ok {
 		return p.MaxSize
 	}
 	return cfg.DefaultPoolMaxSize
 }
+
+func (cfg *Config) GetPoolMaxResultSize(pool string) int {
+	if p, ok := cfg.Pool[pool]; ok && p.MaxResultSize > 0 {
+		return p.MaxResultSize
+	}
+	return cfg.DefaultPoolMaxResultSize
+}
@@ -0,0 +1,529 @@
+// Package ctl implements the "ciri ctl" admin command line tool.
+package ctl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/boiler/ciri/client"
+	"github.com/boiler/ciri/db"
+)
+
+type Config struct {
+	Addr      string `toml:"addr"`
+	AuthToken string `toml:"auth_token"`
+	CAFile    string `toml:"ca_file"`   // CA of the server certificate
+	CertFile  string `toml:"cert_file"` // client certificate for mutual TLS
+	KeyFile   string `toml:"key_file"`
+}
+
+const usage = `usage: ciri ctl [-addr url] [-token token] [-o table|json] <command> [args]
+
+commands:
+  insert    [-id id] [-pool pool] [-sticker sticker] [-priority n] [-body body] [-depends-on ids] | -f file.json
+  list      [filters] [-order field] [-limit n] [-cursor c] [-all]
+  show      <id>
+  requeue   [-priority n] [-delay duration] <id>
+  cancel    <id>
+  delete    <id>
+  pause     <pool>
+  resume    <pool>
+  pools
+  stats     [filters] [-group-by pool,sticker,state,priority]
+  snapshot
+
+filters: -state 0,4 -pool p -sticker s -worker w -priority-min n -priority-max n
+         -added-after t -added-before t -updated-after t -updated-before t
+         (t is a unix timestamp or a duration ago, e.g. 1h)
+
+The server address and token are read from CIRI_ADDR and CIRI_AUTH_TOKEN or
+from the config file at CIRI_CTL_CONFIG_PATH (default ~/.ciri-ctl.conf), which
+also takes ca_file, cert_file and key_file for https servers.
+`
+
+type ctl struct {
+	client *client.Client
+	json   bool
+	out    io.Writer
+}
+
+// Main runs the command and returns the process exit code.
+func Main(args []string) int {
+	cfg := loadConfig()
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addr := fs.String("addr", cfg.Addr, "server address")
+	token := fs.String("token", cfg.AuthToken, "auth token")
+	output := fs.String("o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if !strings.Contains(*addr, "://") {
+		*addr = "http://" + *addr
+	}
+	c := &ctl{
+		client: client.New(*addr, *token),
+		json:   *output == "json",
+		out:    os.Stdout,
+	}
+	c.client.MaxRetries = 0
+	if cfg.CAFile != "" || cfg.CertFile != "" {
+		tlsConfig, err := cfg.tlsConfig()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			return 1
+		}
+		c.client.HTTPClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	if err := c.run(fs.Arg(0), fs.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func loadConfig() *Config {
+	cfg := &Config{Addr: "http://localhost:8080"}
+	path := os.Getenv("CIRI_CTL_CONFIG_PATH")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".ciri-ctl.conf")
+		}
+	}
+	if path != "" {
+		if _, err := os.Stat(path); err == nil {
+			if _, err := toml.DecodeFile(path, cfg); err != nil {
+				fmt.Fprintf(os.Stderr, "config %s: %s\n", path, err)
+			}
+		}
+	}
+	if v := os.Getenv("CIRI_ADDR"); v != "" {
+		cfg.Addr = v
+	}
+	if v := os.Getenv("CIRI_AUTH_TOKEN"); v != "" {
+		cfg.AuthToken = v
+	}
+	return cfg
+}
+
+func (cfg *Config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (c *ctl) run(cmd string, args []string) error {
+	ctx := context.Background()
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+
+	switch cmd {
+	case "insert":
+		task := &db.Task{}
+		fs.StringVar(&task.Id, "id", "", "task id")
+		fs.StringVar(&task.Pool, "pool", "", "pool")
+		fs.StringVar(&task.Sticker, "sticker", "", "sticker")
+		fs.IntVar(&task.Priority, "priority", 0, "priority")
+		fs.StringVar(&task.Body, "body", "", "task body")
+		dependsOn := fs.String("depends-on", "", "comma separated task ids")
+		file := fs.String("f", "", "json file with a task or a list of tasks, - for stdin")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if *file != "" {
+			return c.insertFile(ctx, *file)
+		}
+		if *dependsOn != "" {
+			task.DependsOn = strings.Split(*dependsOn, ",")
+		}
+		id, err := c.client.Insert(ctx, task)
+		if err != nil {
+			return err
+		}
+		return c.print(map[string]string{"id": id}, func(w io.Writer) {
+			fmt.Fprintln(w, id)
+		})
+
+	case "list":
+		filter := AddFilterFlags(fs)
+		opts := &client.ListOptions{}
+		fs.StringVar(&opts.Order, "order", "", "added, updated or priority, - prefix for descending")
+		fs.IntVar(&opts.Limit, "limit", 100, "page size")
+		fs.StringVar(&opts.Cursor, "cursor", "", "cursor of the page")
+		all := fs.Bool("all", false, "fetch all pages")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		f, err := filter()
+		if err != nil {
+			return err
+		}
+		opts.Filter = *f
+		tasks := []*db.Task{}
+		cursor := ""
+		for {
+			page, next, err := c.client.List(ctx, opts)
+			if err != nil {
+				return err
+			}
+			tasks = append(tasks, page...)
+			cursor = next
+			if !*all || next == "" {
+				break
+			}
+			opts.Cursor = next
+		}
+		res := map[string]interface{}{"tasks": tasks}
+		if cursor != "" {
+			res["cursor"] = cursor
+		}
+		return c.print(res, func(w io.Writer) {
+			printTasks(w, tasks)
+			if cursor != "" {
+				fmt.Fprintf(os.Stderr, "next page: -cursor %s\n", cursor)
+			}
+		})
+
+	case "show":
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		id := fs.Arg(0)
+		if id == "" {
+			return fmt.Errorf("task id not specified")
+		}
+		task, err := c.client.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		if task == nil {
+			return fmt.Errorf("task not found")
+		}
+		return c.print(task, func(w io.Writer) {
+			printTask(w, task)
+		})
+
+	case "requeue":
+		priority := fs.String("priority", "", "new priority")
+		delay := fs.Duration("delay", 0, "delay before the task can be acquired")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		id := fs.Arg(0)
+		if id == "" {
+			return fmt.Errorf("task id not specified")
+		}
+		var p *int
+		if *priority != "" {
+			i, err := strconv.Atoi(*priority)
+			if err != nil {
+				return fmt.Errorf("bad priority: %s", *priority)
+			}
+			p = &i
+		}
+		task, err := c.client.Requeue(ctx, id, p, *delay)
+		if err != nil {
+			return err
+		}
+		return c.print(task, func(w io.Writer) {
+			printTask(w, task)
+		})
+
+	case "cancel", "delete":
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		id := fs.Arg(0)
+		if id == "" {
+			return fmt.Errorf("task id not specified")
+		}
+		var err error
+		if cmd == "cancel" {
+			err = c.client.Cancel(ctx, id)
+		} else {
+			err = c.client.Delete(ctx, id)
+		}
+		if err != nil {
+			return err
+		}
+		return c.printOk()
+
+	case "pause", "resume":
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		pool := fs.Arg(0)
+		if pool == "" {
+			return fmt.Errorf("pool not specified")
+		}
+		if err := c.client.PausePool(ctx, pool, cmd == "pause"); err != nil {
+			return err
+		}
+		return c.printOk()
+
+	case "pools":
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		pools, err := c.client.Pools(ctx)
+		if err != nil {
+			return err
+		}
+		return c.print(pools, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(tw, "POOL\tPAUSED\tUPDATED")
+			for _, p := range pools {
+				fmt.Fprintf(tw, "%s\t%t\t%s\n", p.Name, p.Paused, FormatTime(p.Updated))
+			}
+			tw.Flush()
+		})
+
+	case "stats":
+		filter := AddFilterFlags(fs)
+		groupBy := fs.String("group-by", "pool,state", "comma separated: pool, sticker, state, priority")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		f, err := filter()
+		if err != nil {
+			return err
+		}
+		groups := []string{}
+		if *groupBy != "" {
+			groups = strings.Split(*groupBy, ",")
+		}
+		stats, err := c.client.Stats(ctx, f, groups)
+		if err != nil {
+			return err
+		}
+		return c.print(stats, func(w io.Writer) {
+			printStats(w, stats, groups)
+		})
+
+	case "snapshot":
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if err := c.client.Snapshot(ctx); err != nil {
+			return err
+		}
+		return c.printOk()
+	}
+	fs.Usage()
+	return fmt.Errorf("unknown command: %s", cmd)
+}
+
+// AddFilterFlags registers the filter flags, the returned function builds
+// the filter after parsing.
+func AddFilterFlags(fs *flag.FlagSet) func() (*db.Filter, error) {
+	names := []string{"state", "pool", "sticker", "worker", "priority_min", "priority_max",
+		"added_after", "added_before", "updated_after", "updated_before"}
+	values := make(map[string]*string)
+	for _, name := range names {
+		values[name] = fs.String(strings.Replace(name, "_", "-", -1), "", "filter by "+strings.Replace(name, "_", " ", -1))
+	}
+	return func() (*db.Filter, error) {
+		q := url.Values{}
+		for name, v := range values {
+			if *v != "" {
+				q.Set(name, *v)
+			}
+		}
+		return db.ParseFilter(q)
+	}
+}
+
+func (c *ctl) insertFile(ctx context.Context, file string) error {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+	tasks := []*db.Task{}
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		task := &db.Task{}
+		if err := json.Unmarshal(data, task); err != nil {
+			return err
+		}
+		tasks = append(tasks, task)
+	}
+	if len(tasks) == 1 {
+		if _, err := c.client.Insert(ctx, tasks[0]); err != nil {
+			return err
+		}
+	} else if _, err := c.client.InsertBatch(ctx, "", tasks, nil); err != nil {
+		return err
+	}
+	ids := make([]string, len(tasks))
+	for i, t := range tasks {
+		ids[i] = t.Id
+	}
+	return c.print(map[string][]string{"ids": ids}, func(w io.Writer) {
+		for _, id := range ids {
+			fmt.Fprintln(w, id)
+		}
+	})
+}
+
+func (c *ctl) print(v interface{}, table func(w io.Writer)) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	table(c.out)
+	return nil
+}
+
+func (c *ctl) printOk() error {
+	return c.print(map[string]string{"result": "ok"}, func(w io.Writer) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+var stateNames = map[int]string{
+	db.StateNew:       "NEW",
+	db.StateAcquired:  "ACQUIRED",
+	db.StateWork:      "WORK",
+	db.StateDone:      "DONE",
+	db.StateError:     "ERROR",
+	db.StateCancelled: "CANCELLED",
+	db.StateBlocked:   "BLOCKED",
+}
+
+// StateName returns the name of the task state, or its number if unknown.
+func StateName(s int) string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return strconv.Itoa(s)
+}
+
+// FormatTime formats the unix timestamp, "-" for zero.
+func FormatTime(ts uint64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.Unix(int64(ts), 0).Format("2006-01-02 15:04:05")
+}
+
+func printTasks(w io.Writer, tasks []*db.Task) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPOOL\tSTICKER\tPRIORITY\tSTATE\tWORKER\tADDED\tUPDATED\tSTATUS")
+	for _, t := range tasks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", t.Id, t.Pool, t.Sticker, t.Priority,
+			StateName(t.State), t.Worker, FormatTime(t.Added), FormatTime(t.Updated), t.Status)
+	}
+	tw.Flush()
+}
+
+func printTask(w io.Writer, t *db.Task) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "id:\t%s\n", t.Id)
+	fmt.Fprintf(tw, "pool:\t%s\n", t.Pool)
+	fmt.Fprintf(tw, "sticker:\t%s\n", t.Sticker)
+	fmt.Fprintf(tw, "priority:\t%d\n", t.Priority)
+	fmt.Fprintf(tw, "state:\t%s\n", StateName(t.State))
+	fmt.Fprintf(tw, "status:\t%s\n", t.Status)
+	fmt.Fprintf(tw, "worker:\t%s\n", t.Worker)
+	if len(t.DependsOn) > 0 {
+		fmt.Fprintf(tw, "depends on:\t%s\n", strings.Join(t.DependsOn, ", "))
+	}
+	if t.Group != "" {
+		fmt.Fprintf(tw, "group:\t%s\n", t.Group)
+	}
+	if t.Progress != nil {
+		fmt.Fprintf(tw, "progress:\t%.1f%% %s\n", t.Progress.Percent, t.Progress.Step)
+	}
+	fmt.Fprintf(tw, "added:\t%s\n", FormatTime(t.Added))
+	fmt.Fprintf(tw, "updated:\t%s\n", FormatTime(t.Updated))
+	fmt.Fprintf(tw, "started:\t%s\n", FormatTime(t.Started))
+	fmt.Fprintf(tw, "completed:\t%s\n", FormatTime(t.Completed))
+	fmt.Fprintf(tw, "version:\t%d\n", t.Version)
+	fmt.Fprintf(tw, "body:\t%s\n", t.Body)
+	if t.Result != nil {
+		fmt.Fprintf(tw, "result:\t%s\n", t.Result)
+	}
+	tw.Flush()
+}
+
+func printStats(w io.Writer, stats *db.Stats, groups []string) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, g := range groups {
+		fmt.Fprintf(tw, "%s\t", strings.ToUpper(g))
+	}
+	fmt.Fprintln(tw, "COUNT")
+	for _, row := range stats.Rows {
+		for _, g := range groups {
+			switch g {
+			case "pool":
+				fmt.Fprintf(tw, "%s\t", row.Pool)
+			case "sticker":
+				fmt.Fprintf(tw, "%s\t", row.Sticker)
+			case "state":
+				fmt.Fprintf(tw, "%s\t", StateName(*row.State))
+			case "priority":
+				fmt.Fprintf(tw, "%d\t", *row.Priority)
+			}
+		}
+		fmt.Fprintf(tw, "%d\n", row.Count)
+	}
+	tw.Flush()
+
+	fmt.Fprintln(w)
+	pools := make([]string, 0, len(stats.Pools))
+	for p := range stats.Pools {
+		pools = append(pools, p)
+	}
+	sort.Strings(pools)
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tOLDEST NEW\tAVG WAIT\tAVG RUN")
+	for _, p := range pools {
+		ps := stats.Pools[p]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", p,
+			time.Duration(ps.OldestNewAge)*time.Second,
+			time.Duration(ps.AvgWait*float64(time.Second)).Round(time.Second),
+			time.Duration(ps.AvgRun*float64(time.Second)).Round(time.Second))
+	}
+	tw.Flush()
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+type BulkAction struct {
+	Action   string `json:"action"` // requeue, delete, priority, pool
+	Priority int    `json:"priority,omitempty"`
+	Pool     string `json:"pool,omitempty"`
+}
+
+func (a *BulkAction) validate() error {
+	switch a.Action {
+	case "requeue", "delete", "priority":
+	case "pool":
+		if a.Pool == "" {
+			return fmt.Errorf("pool not specified")
+		}
+	default:
+		return fmt.Errorf("unknown action: %s", a.Action)
+	}
+	return nil
+}
+
+// applies reports whether the action changes the task.
+func (a *BulkAction) applies(t *Task) bool {
+	switch a.Action {
+	case "requeue":
+		return t.State == StateDone || t.State == StateError
+	case "priority":
+		return t.Priority != a.Priority
+	case "pool":
+		return t.Pool != a.Pool
+	}
+	return true
+}
+
+// BulkUpdate applies the action to every task matching the filter and returns
+// the number of affected tasks. With batchSize > 0 the tasks are processed in
+// separate transactions of that size, so workers are not blocked for the
+// whole run. With dryRun nothing is changed.
+func (db *DB) BulkUpdate(f *Filter, a *BulkAction, batchSize int, dryRun bool) (int, error) {
+	if err := a.validate(); err != nil {
+		return 0, err
+	}
+	if dryRun {
+		count := 0
+		txn := db.memdb.Txn(false)
+		err := f.Each(txn, func(t *Task) error {
+			if a.applies(t) {
+				count++
+			}
+			return nil
+		})
+		return count, err
+	}
+
+	count := 0
+	done := make(map[string]bool)
+	for {
+		n, err := db.bulkBatch(f, a, batchSize, done)
+		count += n
+		if err != nil {
+			return count, err
+		}
+		if n == 0 || batchSize <= 0 {
+			break
+		}
+	}
+	log.Printf("bulk %s: %d tasks", a.Action, count)
+	return count, nil
+}
+
+func (db *DB) bulkBatch(f *Filter, a *BulkAction, batchSize int, done map[string]bool) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	tasks := []*Task{}
+	errBatchFull := fmt.Errorf("batch full")
+	err := f.Each(txn, func(t *Task) error {
+		if done[t.Id] || !a.applies(t) {
+			return nil
+		}
+		if batchSize > 0 && len(tasks) >= batchSize {
+			return errBatchFull
+		}
+		tasks = append(tasks, t)
+		return nil
+	})
+	if err != nil && err != errBatchFull {
+		return 0, err
+	}
+
+	now := uint64(time.Now().Unix())
+	for _, t := range tasks {
+		done[t.Id] = true
+		// an earlier task of the batch may have changed it, e.g. via dependencies
+		r, err := txn.First("tasks", "id", t.Id)
+		if err != nil {
+			return 0, err
+		}
+		if r == nil {
+			continue
+		}
+		t = r.(*Task)
+		if a.Action == "delete" {
+			if err := db.deleteTask(txn, t); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		task := *t // copy required for update
+		switch a.Action {
+		case "requeue":
+			requeue(&task)
+		case "priority":
+			task.Priority = a.Priority
+		case "pool":
+			task.Pool = a.Pool
+		}
+		task.Updated = now
+		if err := db.replaceTask(txn, a.Action, t, &task); err != nil {
+			return 0, err
+		}
+	}
+	if err := db.commit(txn); err != nil {
+		return 0, err
+	}
+	return len(tasks), nil
+}
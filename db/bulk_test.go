@@ -0,0 +1,40 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBulkRequeue(t *testing.T) {
+	db := newTestDB(t, nil)
+	later := uint64(time.Now().Unix()) + 3600
+	tasks := []*Task{
+		{Id: "done", Pool: "p", State: StateDone, NotBefore: later},
+		{Id: "error", Pool: "p", State: StateError},
+		{Id: "cancelled", Pool: "p", State: StateCancelled},
+		{Id: "new", Pool: "p", State: StateNew},
+	}
+	if _, err := db.ImportTasks(tasks, ImportFail, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &BulkAction{Action: "requeue"}
+	if n, err := db.BulkUpdate(&Filter{Pool: "p"}, a, 0, true); err != nil || n != 2 {
+		t.Fatalf("dry run: %d, %v; expected 2", n, err)
+	}
+	if n, err := db.BulkUpdate(&Filter{Pool: "p"}, a, 1, false); err != nil || n != 2 {
+		t.Fatalf("requeue: %d, %v; expected 2", n, err)
+	}
+	for id, state := range map[string]int{"done": StateNew, "error": StateNew, "cancelled": StateCancelled, "new": StateNew} {
+		task, err := db.GetTask("id", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task.State != state {
+			t.Errorf("task %s: state %d, expected %d", id, task.State, state)
+		}
+		if task.NotBefore != 0 {
+			t.Errorf("task %s: not_before %d kept", id, task.NotBefore)
+		}
+	}
+}
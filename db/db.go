@@ -1,12 +1,8 @@
 package db
 
 import (
-	"bufio"
-	"encoding/gob"
-	"fmt"
-	"io"
+	"encoding/json"
 	"log"
-	"os"
 	"sync"
 	"time"
 
@@ -16,29 +12,91 @@ import (
 	"github.com/hashicorp/go-memdb"
 )
 
+const (
+	StateNew = iota
+	StateAcquired
+	StateWork
+	StateDone
+	StateError
+	StateCancelled
+	StateBlocked
+)
+
 type Task struct {
-	Id       string `json:"id"`
-	Sticker  string `json:"sticker"`
-	Priority int    `json:"priority"`
-	Body     string `json:"body"`
-	Pool     string `json:"pool"`
-	State    int    `json:"state"` // 0:NEW, 1:ACQUIRED, 2:WORK, 3:DONE, 4:ERROR
-	Status   string `json:"status,omitempty"`
-	Worker   string `json:"worker,omitempty"`
-	Added    uint64 `json:"added"`
-	Updated  uint64 `json:"updated"`
+	Id              string          `json:"id"`
+	Sticker         string          `json:"sticker"`
+	Priority        int             `json:"priority"`
+	Body            string          `json:"body"`
+	Pool            string          `json:"pool"`
+	State           int             `json:"state"` // 0:NEW, 1:ACQUIRED, 2:WORK, 3:DONE, 4:ERROR, 5:CANCELLED, 6:BLOCKED
+	Status          string          `json:"status,omitempty"`
+	Worker          string          `json:"worker,omitempty"`
+	CancelRequested bool            `json:"cancel_requested,omitempty"`
+	DependsOn       []string        `json:"depends_on,omitempty"`
+	Group           string          `json:"group,omitempty"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	Progress        *Progress       `json:"progress,omitempty"`
+	Messages        []StatusMessage `json:"messages,omitempty"`
+	Added           uint64          `json:"added"`
+	Updated         uint64          `json:"updated"`
+	Started         uint64          `json:"started,omitempty"`
+	Completed       uint64          `json:"completed,omitempty"`
+	NotBefore       uint64          `json:"not_before,omitempty"` // not acquired before this time
+	Version         uint64          `json:"version"`              // incremented on every change
+}
+
+type Progress struct {
+	Percent float64            `json:"percent"`
+	Step    string             `json:"step,omitempty"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+type StatusMessage struct {
+	Time   uint64 `json:"time"`
+	Worker string `json:"worker,omitempty"`
+	State  int    `json:"state"`
+	Status string `json:"status"`
+}
+
+// Active reports whether the task is held by a worker.
+func (t *Task) Active() bool {
+	return t.State == StateAcquired || t.State == StateWork
 }
 
+// Finished reports whether the task reached a terminal state.
+func (t *Task) Finished() bool {
+	return t.State == StateDone || t.State == StateError || t.State == StateCancelled
+}
+
+// DB is a view of the shared store, the actor of the view is recorded in
+// the task history.
 type DB struct {
-	mutex sync.Mutex
-	memdb *memdb.MemDB
-	cfg   *config.Config
+	*store
+	actor string
+}
+
+type store struct {
+	mutex          sync.Mutex
+	snapshotMutex  sync.Mutex // serializes writers of the snapshot file
+	statusMutex    sync.Mutex // guards snapshotStatus
+	snapshotStatus SnapshotStatus
+	memdb          *memdb.MemDB
+	cfg            *config.Config
+	events         *EventLog
+	changes        *ChangeLog
+	replicator     Replicator
+	keys           *Keys // nil without encryption
+
+	// queued by the current write transaction until it commits; write
+	// transactions are serialized by mutex, so a single pending list is enough
+	pendingEvents []*Event
+	pendingFns    []func()
 }
 
 func NewDB(cfg *config.Config) (*DB, error) {
 	conditionalTaskActive := func(obj interface{}) (bool, error) {
 		task, _ := obj.(*Task)
-		return task.State > 0 && task.State < 3, nil
+		return task.Active(), nil
 	}
 	schema := &memdb.DBSchema{
 		Tables: map[string]*memdb.TableSchema{
@@ -55,6 +113,44 @@ func NewDB(cfg *config.Config) (*DB, error) {
 						Unique:  false,
 						Indexer: &memdb.StringFieldIndex{Field: "Sticker"},
 					},
+					"pool": &memdb.IndexSchema{
+						Name:    "pool",
+						Unique:  false,
+						Indexer: &memdb.StringFieldIndex{Field: "Pool"},
+					},
+					"worker": &memdb.IndexSchema{
+						Name:         "worker",
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Worker"},
+					},
+					// with the id, so that queries continue from a cursor
+					"added": &memdb.IndexSchema{
+						Name: "added",
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.UintFieldIndex{Field: "Added"},
+								&memdb.StringFieldIndex{Field: "Id"},
+							},
+						},
+					},
+					"updated": &memdb.IndexSchema{
+						Name: "updated",
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.UintFieldIndex{Field: "Updated"},
+								&memdb.StringFieldIndex{Field: "Id"},
+							},
+						},
+					},
+					"priority": &memdb.IndexSchema{
+						Name: "priority",
+						Indexer: &memdb.CompoundIndex{
+							Indexes: []memdb.Indexer{
+								&memdb.IntFieldIndex{Field: "Priority"},
+								&memdb.StringFieldIndex{Field: "Id"},
+							},
+						},
+					},
 					"state": &memdb.IndexSchema{
 						Name: "state",
 						Indexer: &memdb.IntFieldIndex{
@@ -77,6 +173,16 @@ func NewDB(cfg *config.Config) (*DB, error) {
 							},
 						},
 					},
+					"depends_on": &memdb.IndexSchema{
+						Name:         "depends_on",
+						AllowMissing: true,
+						Indexer:      &memdb.StringSliceFieldIndex{Field: "DependsOn"},
+					},
+					"group": &memdb.IndexSchema{
+						Name:         "group",
+						AllowMissing: true,
+						Indexer:      &memdb.StringFieldIndex{Field: "Group"},
+					},
 					"poolactive": &memdb.IndexSchema{
 						Name: "poolactive",
 						Indexer: &memdb.CompoundIndex{
@@ -92,16 +198,74 @@ func NewDB(cfg *config.Config) (*DB, error) {
 					},
 				},
 			},
+			"history": &memdb.TableSchema{
+				Name: "history",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Id"},
+					},
+				},
+			},
+			"pools": &memdb.TableSchema{
+				Name: "pools",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Name"},
+					},
+				},
+			},
+			"groups": &memdb.TableSchema{
+				Name: "groups",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Id"},
+					},
+				},
+			},
+			"members": &memdb.TableSchema{
+				Name: "members",
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": &memdb.IndexSchema{
+						Name:    "id",
+						Unique:  true,
+						Indexer: &memdb.StringFieldIndex{Field: "Id"},
+					},
+				},
+			},
 		},
 	}
 	mdb, err := memdb.NewMemDB(schema)
 	if err != nil {
 		return nil, err
 	}
-	return &DB{
-		memdb: mdb,
-		cfg:   cfg,
-	}, nil
+	keys, err := LoadKeys(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{store: &store{
+		memdb:   mdb,
+		cfg:     cfg,
+		events:  NewEventLog(cfg.EventBufferSize),
+		changes: NewChangeLog(cfg.ReplicationLogSize),
+		keys:    keys,
+	}}, nil
+}
+
+// Keys returns the encryption keys of the snapshots, nil if not configured.
+func (db *DB) Keys() *Keys {
+	return db.keys
+}
+
+// WithActor returns a view of the db recording name, e.g. of the API token,
+// as the actor of its changes.
+func (db *DB) WithActor(name string) *DB {
+	return &DB{store: db.store, actor: name}
 }
 
 func countResultIterator(it memdb.ResultIterator) int {
@@ -119,8 +283,15 @@ func (db *DB) EmptyTask() Task {
 func (db *DB) InsertTasks(tasks []*Task) error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	txn := db.memdb.Txn(true)
+	txn := db.writeTxn()
 	defer txn.Abort()
+	if err := db.insertTasks(txn, tasks); err != nil {
+		return err
+	}
+	return db.commit(txn)
+}
+
+func (db *DB) insertTasks(txn *memdb.Txn, tasks []*Task) error {
 	for _, t := range tasks {
 		if t.Id == "" {
 			t.Id = uuid.NewString()
@@ -130,9 +301,14 @@ func (db *DB) InsertTasks(tasks []*Task) error {
 				return err
 			}
 			if r != nil {
-				return fmt.Errorf("duplicate key: id")
+				return errorf(KindConflict, "duplicate key: id")
 			}
 		}
+	}
+	if err := db.resolveDependencies(txn, tasks); err != nil {
+		return err
+	}
+	for _, t := range tasks {
 		if t.Sticker == "" {
 			t.Sticker = "default"
 		}
@@ -141,21 +317,28 @@ func (db *DB) InsertTasks(tasks []*Task) error {
 		}
 		t.Added = uint64(time.Now().Unix())
 		t.Updated = t.Added
+		t.Version = 1
 		if err := txn.Insert("tasks", t); err != nil {
 			return err
 		}
-		metrics.CountAdd("tasks_inserted", 1, t.Sticker, t.Priority, t.Pool)
-		metrics.GaugeInc("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
-		log.Printf("task %s inserted", t.Id)
+		if err := db.recordTransition(txn, "insert", t.State, t); err != nil {
+			return err
+		}
+		db.onCommit(func() {
+			metrics.CountAdd("tasks_inserted", 1, t.Sticker, t.Priority, t.Pool)
+			metrics.GaugeInc("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
+			log.Printf("task %s inserted", t.Id)
+		})
 	}
-	txn.Commit()
 	return nil
 }
 
-func (db *DB) AcquireTask(workerName string) (*Task, error) {
+// AcquireTask returns the task held by the worker, or acquires the next NEW
+// task accepted by allow; nil allow accepts any.
+func (db *DB) AcquireTask(workerName string, allow func(*Task) bool) (*Task, error) {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	txn := db.memdb.Txn(true)
+	txn := db.writeTxn()
 	defer txn.Abort()
 
 	poolSizeMap := make(map[string]int)
@@ -171,6 +354,18 @@ func (db *DB) AcquireTask(workerName string) (*Task, error) {
 		poolSizeMap[p] = countResultIterator(it)
 		return poolSizeMap[p], nil
 	}
+	poolPausedMap := make(map[string]bool)
+	isPoolPaused := func(p string) (bool, error) {
+		if paused, ok := poolPausedMap[p]; ok {
+			return paused, nil
+		}
+		r, err := txn.First("pools", "id", p)
+		if err != nil {
+			return false, err
+		}
+		poolPausedMap[p] = r != nil && r.(*Pool).Paused
+		return poolPausedMap[p], nil
+	}
 
 	task := db.EmptyTask() // copy required for update
 	updateMetrics := true
@@ -192,13 +387,24 @@ activeLoop:
 	}
 
 	if task.Id == "" {
+		now := uint64(time.Now().Unix())
 		it, err := txn.Get("tasks", "q")
 		if err != nil {
 			return nil, err
 		}
 		for obj := it.Next(); obj != nil; obj = it.Next() {
 			t := obj.(*Task)
-			if t.State != 0 {
+			if t.State != 0 || t.NotBefore > now {
+				continue
+			}
+			if allow != nil && !allow(t) {
+				continue
+			}
+			paused, err := isPoolPaused(t.Pool)
+			if err != nil {
+				return nil, err
+			}
+			if paused {
 				continue
 			}
 			poolSize, err := getPoolSize(t.Pool)
@@ -216,14 +422,26 @@ activeLoop:
 		return nil, nil
 	}
 
+	oldState := task.State
 	task.State = 1
 	task.Worker = workerName
 	task.Updated = uint64(time.Now().Unix())
+	task.Version++
+	if updateMetrics {
+		task.Started = task.Updated
+	}
 
 	if err := txn.Insert("tasks", &task); err != nil { // update
 		return nil, err
 	}
-	txn.Commit()
+	if updateMetrics {
+		if err := db.recordTransition(txn, "acquire", oldState, &task); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.commit(txn); err != nil {
+		return nil, err
+	}
 	log.Printf("task %s acquired by worker %s", task.Id, workerName)
 	if updateMetrics {
 		metrics.CountAdd("tasks_acquired", 1, task.Sticker, task.Priority, task.Pool)
@@ -233,21 +451,80 @@ activeLoop:
 	return &task, nil
 }
 
-func (db *DB) UpdateTask(t *Task, state int, status string) error {
+// UpdateTask moves the task to the state reported by its worker and returns
+// the updated task. The result is stored only when the task finishes; progress
+// metrics are merged into the ones reported before. The task is read again
+// under the lock, if it changed since t was read the update is a conflict, so
+// a cancel or a requeue in between isn't overwritten.
+func (db *DB) UpdateTask(t *Task, state int, status string, result json.RawMessage, progress *Progress) (*Task, error) {
+	if len(result) > db.cfg.GetPoolMaxResultSize(t.Pool) {
+		return nil, errorf(KindTooLarge, "result too large: %d bytes", len(result))
+	}
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	txn := db.memdb.Txn(true)
+	txn := db.writeTxn()
 	defer txn.Abort()
 
+	r, err := txn.First("tasks", "id", t.Id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errorf(KindNotFound, "task not found")
+	}
+	if cur := r.(*Task); cur.State != t.State || cur.Worker != t.Worker || cur.Version != t.Version {
+		return nil, errorf(KindConflict, "task version mismatch")
+	}
+	t = r.(*Task)
+
+	// a worker giving up on a task with pending cancellation finishes it
+	if t.CancelRequested && (state == StateNew || state == StateError) {
+		state = StateCancelled
+	}
+
 	task := *t // copy required for update
 	task.State = state
 	task.Status = status
 	task.Updated = uint64(time.Now().Unix())
+	if task.Finished() {
+		task.Completed = task.Updated
+		if result != nil {
+			task.Result = result
+		}
+	}
+	if progress != nil {
+		task.Progress = mergeProgress(t.Progress, progress)
+	}
+	// repeated heartbeats with the same status are not recorded
+	if status != "" && (status != t.Status || state != t.State) {
+		task.Messages = appendMessage(t.Messages, db.cfg.StatusHistorySize, StatusMessage{
+			Time:   task.Updated,
+			Worker: t.Worker,
+			State:  state,
+			Status: status,
+		})
+	}
+	task.Version++
 
 	if err := txn.Insert("tasks", &task); err != nil { // update
-		return err
+		return nil, err
+	}
+	if state != t.State || status != t.Status {
+		if err := db.recordTransition(txn, "update", t.State, &task); err != nil {
+			return nil, err
+		}
+	} else {
+		// heartbeats are streamed, but not kept in the history
+		db.emitEvent(txn, eventType("update", &task), &task)
+	}
+	if task.Finished() {
+		if err := db.finishTask(txn, &task); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.commit(txn); err != nil {
+		return nil, err
 	}
-	txn.Commit()
 
 	metrics.GaugeDec("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
 	metrics.GaugeInc("tasks_count", task.Sticker, task.Priority, task.Pool, task.State)
@@ -260,25 +537,185 @@ func (db *DB) UpdateTask(t *Task, state int, status string) error {
 		metrics.CountAdd("tasks_done", 1, task.Sticker, task.Priority, task.State, true)
 	case 0:
 		metrics.CountAdd("tasks_refused", 1, task.Sticker, task.Priority, task.State)
+	case StateCancelled:
+		metrics.CountAdd("tasks_cancelled", 1, task.Sticker, task.Priority, task.Pool)
 	default:
 		metrics.CountAdd("tasks_updated", 1, task.Sticker, task.Priority, task.Pool)
 	}
-	return nil
+	return &task, nil
+}
+
+// finishTask runs the actions due when a task reaches a terminal state.
+func (db *DB) finishTask(txn *memdb.Txn, task *Task) error {
+	if err := db.releaseDependents(txn, task, false); err != nil {
+		return err
+	}
+	return db.checkGroup(txn, task.Group)
+}
+
+func mergeProgress(old *Progress, p *Progress) *Progress {
+	progress := *p
+	if old != nil {
+		if progress.Step == "" {
+			progress.Step = old.Step
+		}
+		metrics := make(map[string]float64)
+		for k, v := range old.Metrics {
+			metrics[k] = v
+		}
+		for k, v := range p.Metrics {
+			metrics[k] = v
+		}
+		progress.Metrics = metrics
+	}
+	return &progress
+}
+
+// appendMessage returns a new slice, the old one may be shared with a task in
+// memdb.
+func appendMessage(messages []StatusMessage, size int, m StatusMessage) []StatusMessage {
+	if size <= 0 {
+		return nil
+	}
+	if len(messages) >= size {
+		messages = messages[len(messages)-size+1:]
+	}
+	res := make([]StatusMessage, 0, len(messages)+1)
+	res = append(res, messages...)
+	return append(res, m)
+}
+
+// CancelTasks cancels every task matching the index. NEW tasks are cancelled
+// immediately, active ones get the cancel flag which is returned to the worker
+// on its next update or acquire. Finished tasks are left untouched.
+func (db *DB) CancelTasks(index string, args ...interface{}) (cancelled int, requested int, err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	it, err := txn.Get("tasks", index, args...)
+	if err != nil {
+		return 0, 0, err
+	}
+	tasks := []*Task{}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		tasks = append(tasks, obj.(*Task))
+	}
+
+	now := uint64(time.Now().Unix())
+	for _, t := range tasks {
+		task := *t // copy required for update
+		switch {
+		case t.State == StateNew || t.State == StateBlocked:
+			task.State = StateCancelled
+			task.Status = "cancelled"
+		case t.Active() && !t.CancelRequested:
+			task.CancelRequested = true
+		default:
+			continue
+		}
+		task.Updated = now
+		task.Version++
+		if task.Finished() {
+			task.Completed = now
+		}
+		if err := txn.Insert("tasks", &task); err != nil { // update
+			return 0, 0, err
+		}
+		if err := db.recordTransition(txn, "cancel", t.State, &task); err != nil {
+			return 0, 0, err
+		}
+		if task.State == StateCancelled {
+			cancelled++
+			oldState := t.State
+			db.onCommit(func() {
+				log.Printf("task %s cancelled", task.Id)
+				metrics.CountAdd("tasks_cancelled", 1, task.Sticker, task.Priority, task.Pool)
+				metrics.GaugeDec("tasks_count", task.Sticker, task.Priority, task.Pool, oldState)
+				metrics.GaugeInc("tasks_count", task.Sticker, task.Priority, task.Pool, task.State)
+			})
+			if err := db.finishTask(txn, &task); err != nil {
+				return 0, 0, err
+			}
+		} else {
+			requested++
+			db.onCommit(func() {
+				log.Printf("task %s cancel requested, worker: %s", task.Id, task.Worker)
+			})
+		}
+	}
+	if err := db.commit(txn); err != nil {
+		return 0, 0, err
+	}
+	return cancelled, requested, nil
+}
+
+// PurgeResults drops stored results of the tasks matching the index, keeping
+// the task records.
+func (db *DB) PurgeResults(index string, args ...interface{}) (int, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	it, err := txn.Get("tasks", index, args...)
+	if err != nil {
+		return 0, err
+	}
+	tasks := []*Task{}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		if t := obj.(*Task); t.Result != nil {
+			tasks = append(tasks, t)
+		}
+	}
+	for _, t := range tasks {
+		task := *t // copy required for update
+		task.Result = nil
+		task.Version++
+		if err := txn.Insert("tasks", &task); err != nil { // update
+			return 0, err
+		}
+	}
+	if err := db.commit(txn); err != nil {
+		return 0, err
+	}
+	log.Printf("results purged: %d tasks", len(tasks))
+	return len(tasks), nil
 }
 
 func (db *DB) DeleteTask(t *Task) error {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
-	txn := db.memdb.Txn(true)
+	txn := db.writeTxn()
 	defer txn.Abort()
 
+	if err := db.deleteTask(txn, t); err != nil {
+		return err
+	}
+	return db.commit(txn)
+}
+
+func (db *DB) deleteTask(txn *memdb.Txn, t *Task) error {
 	if err := txn.Delete("tasks", t); err != nil {
 		return err
 	}
-	txn.Commit()
-	log.Printf("task %s deleted: state: %d", t.Id, t.State)
-	metrics.CountAdd("tasks_deleted", 1, t.Sticker, t.Priority, t.Pool)
-	metrics.GaugeDec("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
+	if err := db.recordTransition(txn, "delete", t.State, t); err != nil {
+		return err
+	}
+	if !t.Finished() {
+		if err := db.releaseDependents(txn, t, true); err != nil {
+			return err
+		}
+	}
+	if err := db.checkGroup(txn, t.Group); err != nil {
+		return err
+	}
+	db.onCommit(func() {
+		log.Printf("task %s deleted: state: %d", t.Id, t.State)
+		metrics.CountAdd("tasks_deleted", 1, t.Sticker, t.Priority, t.Pool)
+		metrics.GaugeDec("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
+	})
 	return nil
 }
 
@@ -324,68 +761,3 @@ func (db *DB) GetTasksBetweenState(ch chan *Task, stateStart int, stateEnd int)
 	}
 	return nil
 }
-
-func (db *DB) WriteSnapshot(path string) error {
-	log.Printf("writing snapshot: %s", path)
-	txn := db.memdb.Txn(false)
-	defer txn.Abort()
-	it, err := txn.Get("tasks", "id")
-	if err != nil {
-		return err
-	}
-	f, err := os.Create(path + ".tmp")
-	if err != nil {
-		return err
-	}
-	w := bufio.NewWriter(f)
-	enc := gob.NewEncoder(w)
-	for obj := it.Next(); obj != nil; obj = it.Next() {
-		t := obj.(*Task)
-		err = enc.Encode(t)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-	w.Flush()
-	f.Close()
-	err = os.Rename(path+".tmp", path)
-	if err != nil {
-		return err
-	}
-	log.Print("writing snapshot done")
-	return nil
-}
-
-func (db *DB) ReadSnapshot(path string) error {
-	if _, err := os.Stat(path); err != nil {
-		return nil
-	}
-	log.Printf("reading snapshot: %s", path)
-	f, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	dec := gob.NewDecoder(bufio.NewReader(f))
-	db.mutex.Lock()
-	defer db.mutex.Unlock()
-	txn := db.memdb.Txn(true)
-
-	for {
-		var t Task
-		err := dec.Decode(&t)
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		err = txn.Insert("tasks", &t)
-		if err != nil {
-			return err
-		}
-		metrics.GaugeInc("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
-	}
-	txn.Commit()
-	log.Printf("reading snapshot done")
-	return nil
-}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/boiler/ciri/config"
+)
+
+func newTestDB(t *testing.T, cfg *config.Config) *DB {
+	t.Helper()
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	if cfg.DefaultPoolMaxSize == 0 {
+		cfg.DefaultPoolMaxSize = 8
+	}
+	if cfg.DefaultPoolMaxResultSize == 0 {
+		cfg.DefaultPoolMaxResultSize = 65536
+	}
+	db, err := NewDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func insertTask(t *testing.T, db *DB, id string) {
+	t.Helper()
+	task := db.EmptyTask()
+	task.Id = id
+	if err := db.InsertTasks([]*Task{&task}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func acquire(t *testing.T, db *DB, worker string) *Task {
+	t.Helper()
+	task, err := db.AcquireTask(worker, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task == nil {
+		t.Fatalf("no task for %s", worker)
+	}
+	return task
+}
+
+func TestUpdateResultTooLarge(t *testing.T) {
+	db := newTestDB(t, &config.Config{DefaultPoolMaxResultSize: 8})
+	insertTask(t, db, "t1")
+	task := acquire(t, db, "w1")
+	if _, err := db.UpdateTask(task, StateDone, "", []byte(`"too large"`), nil); ErrorKind(err) != KindTooLarge {
+		t.Errorf("large result: %v, expected too_large", err)
+	}
+	if _, err := db.UpdateTask(task, StateDone, "", []byte(`"ok"`), nil); err != nil {
+		t.Error(err)
+	}
+}
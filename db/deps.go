@@ -0,0 +1,243 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/boiler/ciri/metrics"
+	"github.com/hashicorp/go-memdb"
+)
+
+type TaskNode struct {
+	Id         string   `json:"id"`
+	State      int      `json:"state"`
+	Status     string   `json:"status,omitempty"`
+	DependsOn  []string `json:"depends_on,omitempty"`
+	Dependents []string `json:"dependents,omitempty"`
+}
+
+// resolveDependencies validates depends_on of the inserted tasks and sets
+// their initial state. Dependencies may point to existing tasks or to tasks
+// of the same batch; cycles are only possible within the batch.
+func (db *DB) resolveDependencies(txn *memdb.Txn, tasks []*Task) error {
+	batch := make(map[string]*Task)
+	for _, t := range tasks {
+		if _, ok := batch[t.Id]; ok {
+			return errorf(KindConflict, "duplicate key: id")
+		}
+		batch[t.Id] = t
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		resolved
+	)
+	marks := make(map[string]int)
+	var resolve func(t *Task, path []string) error
+	resolve = func(t *Task, path []string) error {
+		switch marks[t.Id] {
+		case resolved:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, t.Id), " -> "))
+		}
+		marks[t.Id] = visiting
+		path = append(path, t.Id)
+
+		var deps []string
+		seen := make(map[string]bool)
+		for _, id := range t.DependsOn {
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			deps = append(deps, id)
+		}
+		t.DependsOn = deps
+
+		blocked := false
+		for _, id := range deps {
+			var dep *Task
+			if bt, ok := batch[id]; ok {
+				if err := resolve(bt, path); err != nil {
+					return err
+				}
+				dep = bt
+			} else {
+				r, err := txn.First("tasks", "id", id)
+				if err != nil {
+					return err
+				}
+				if r == nil {
+					return fmt.Errorf("dependency not found: %s", id)
+				}
+				dep = r.(*Task)
+			}
+			switch dep.State {
+			case StateDone:
+			case StateError, StateCancelled:
+				if !t.Finished() {
+					t.State = dep.State
+					t.Status = fmt.Sprintf("dependency %s %s", id, stateVerb(dep.State))
+				}
+			default:
+				blocked = true
+			}
+		}
+		if len(deps) > 0 && !t.Finished() {
+			if blocked {
+				t.State = StateBlocked
+			} else {
+				t.State = StateNew
+			}
+		}
+		marks[t.Id] = resolved
+		return nil
+	}
+	for _, t := range tasks {
+		if err := resolve(t, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseDependents promotes or fails BLOCKED tasks waiting for parent, which
+// just finished or got deleted. Failures cascade down the graph.
+func (db *DB) releaseDependents(txn *memdb.Txn, parent *Task, deleted bool) error {
+	it, err := txn.Get("tasks", "depends_on", parent.Id)
+	if err != nil {
+		return err
+	}
+	dependents := []*Task{}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		t := obj.(*Task)
+		if t.State == StateBlocked {
+			dependents = append(dependents, t)
+		}
+	}
+
+	now := uint64(time.Now().Unix())
+	for _, t := range dependents {
+		task := *t // copy required for update
+		switch {
+		case deleted:
+			task.State = StateError
+			task.Status = fmt.Sprintf("dependency %s deleted", parent.Id)
+		case parent.State == StateError || parent.State == StateCancelled:
+			task.State = parent.State
+			task.Status = fmt.Sprintf("dependency %s %s", parent.Id, stateVerb(parent.State))
+		case parent.State == StateDone:
+			ready, err := dependenciesDone(txn, &task)
+			if err != nil {
+				return err
+			}
+			if !ready {
+				continue
+			}
+			task.State = StateNew
+		default:
+			continue
+		}
+		task.Updated = now
+		task.Version++
+		if task.Finished() {
+			task.Completed = now
+		}
+		if err := txn.Insert("tasks", &task); err != nil { // update
+			return err
+		}
+		if err := db.recordTransition(txn, "release", t.State, &task); err != nil {
+			return err
+		}
+		db.onCommit(func() {
+			log.Printf("task %s released: state: %d, status: %s", task.Id, task.State, task.Status)
+			metrics.GaugeDec("tasks_count", task.Sticker, task.Priority, task.Pool, StateBlocked)
+			metrics.GaugeInc("tasks_count", task.Sticker, task.Priority, task.Pool, task.State)
+		})
+		if task.Finished() {
+			if err := db.finishTask(txn, &task); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dependenciesDone reports whether every dependency of t is DONE. A missing
+// dependency was deleted after it had finished successfully, otherwise its
+// dependents would have been failed on delete.
+func dependenciesDone(txn *memdb.Txn, t *Task) (bool, error) {
+	for _, id := range t.DependsOn {
+		r, err := txn.First("tasks", "id", id)
+		if err != nil {
+			return false, err
+		}
+		if r != nil && r.(*Task).State != StateDone {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func stateVerb(state int) string {
+	if state == StateCancelled {
+		return "cancelled"
+	}
+	return "failed"
+}
+
+// GetTaskGraph returns the task with all its transitive dependencies and
+// dependents.
+func (db *DB) GetTaskGraph(id string) ([]*TaskNode, error) {
+	txn := db.memdb.Txn(false)
+	r, err := txn.First("tasks", "id", id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, nil
+	}
+
+	nodes := []*TaskNode{}
+	nodeMap := make(map[string]*TaskNode)
+	queue := []*Task{r.(*Task)}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if _, ok := nodeMap[t.Id]; ok {
+			continue
+		}
+		node := &TaskNode{
+			Id:        t.Id,
+			State:     t.State,
+			Status:    t.Status,
+			DependsOn: t.DependsOn,
+		}
+		nodeMap[t.Id] = node
+		nodes = append(nodes, node)
+
+		for _, depId := range t.DependsOn {
+			r, err := txn.First("tasks", "id", depId)
+			if err != nil {
+				return nil, err
+			}
+			if r != nil {
+				queue = append(queue, r.(*Task))
+			}
+		}
+		it, err := txn.Get("tasks", "depends_on", t.Id)
+		if err != nil {
+			return nil, err
+		}
+		for obj := it.Next(); obj != nil; obj = it.Next() {
+			dt := obj.(*Task)
+			node.Dependents = append(node.Dependents, dt.Id)
+			queue = append(queue, dt)
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/boiler/ciri/metrics"
+	"github.com/hashicorp/go-memdb"
+)
+
+// requeue resets the task to NEW, dropping the outcome of the last run and
+// its delay.
+func requeue(task *Task) {
+	task.State = StateNew
+	task.Status = ""
+	task.Worker = ""
+	task.CancelRequested = false
+	task.Result = nil
+	task.Progress = nil
+	task.Started = 0
+	task.Completed = 0
+	task.NotBefore = 0
+}
+
+// replaceTask stores the updated copy of old, moving the task between the
+// tasks_count gauges.
+func (db *DB) replaceTask(txn *memdb.Txn, action string, old *Task, task *Task) error {
+	task.Version = old.Version + 1
+	if err := txn.Insert("tasks", task); err != nil { // update
+		return err
+	}
+	if err := db.recordTransition(txn, action, old.State, task); err != nil {
+		return err
+	}
+	if old.Finished() && !task.Finished() && task.Group != "" {
+		if err := reopenGroup(txn, task.Group); err != nil {
+			return err
+		}
+	}
+	db.onCommit(func() {
+		log.Printf("task %s %s: state: %d, priority: %d, pool: %s", task.Id, action, task.State, task.Priority, task.Pool)
+		metrics.GaugeDec("tasks_count", old.Sticker, old.Priority, old.Pool, old.State)
+		metrics.GaugeInc("tasks_count", task.Sticker, task.Priority, task.Pool, task.State)
+	})
+	return nil
+}
+
+// TaskEdit holds the fields to change on a task that is not acquired yet.
+type TaskEdit struct {
+	Priority  *int    `json:"priority"`
+	Pool      *string `json:"pool"`
+	Sticker   *string `json:"sticker"`
+	Body      *string `json:"body"`
+	NotBefore *uint64 `json:"not_before"`
+}
+
+// EditTask changes a NEW or BLOCKED task. A non-zero version must match the
+// current one, so concurrent edits don't overwrite each other; the state is
+// checked under the lock, so an edit can't race with AcquireTask.
+func (db *DB) EditTask(id string, version uint64, e *TaskEdit) (*Task, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	r, err := txn.First("tasks", "id", id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errorf(KindNotFound, "task not found")
+	}
+	t := r.(*Task)
+	if version != 0 && version != t.Version {
+		return nil, errorf(KindConflict, "task version mismatch")
+	}
+	if t.State != StateNew && t.State != StateBlocked {
+		return nil, errorf(KindConflict, "task not new")
+	}
+
+	task := *t // copy required for update
+	if e.Priority != nil {
+		task.Priority = *e.Priority
+	}
+	if e.Pool != nil {
+		task.Pool = *e.Pool
+		if task.Pool == "" {
+			task.Pool = "default"
+		}
+	}
+	if e.Sticker != nil {
+		task.Sticker = *e.Sticker
+		if task.Sticker == "" {
+			task.Sticker = "default"
+		}
+	}
+	if e.Body != nil {
+		task.Body = *e.Body
+	}
+	if e.NotBefore != nil {
+		task.NotBefore = *e.NotBefore
+	}
+	task.Updated = uint64(time.Now().Unix())
+	if err := db.replaceTask(txn, "edit", t, &task); err != nil {
+		return nil, err
+	}
+	if err := db.commit(txn); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// RequeueTask moves a finished or stuck active task back to NEW keeping its
+// id, optionally with a new priority and a delay in seconds before it can be
+// acquired again. The previous worker is not told; its late reports fail the
+// state, worker and version check of UpdateTask against the requeued task.
+func (db *DB) RequeueTask(id string, priority *int, delay uint64) (*Task, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	r, err := txn.First("tasks", "id", id)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errorf(KindNotFound, "task not found")
+	}
+	t := r.(*Task)
+	if !t.Finished() && !t.Active() {
+		return nil, errorf(KindConflict, "task not finished or acquired")
+	}
+
+	task := *t // copy required for update
+	requeue(&task)
+	if priority != nil {
+		task.Priority = *priority
+	}
+	task.Updated = uint64(time.Now().Unix())
+	if delay > 0 {
+		task.NotBefore = task.Updated + delay
+	}
+	if err := db.replaceTask(txn, "requeue", t, &task); err != nil {
+		return nil, err
+	}
+	if err := db.commit(txn); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
@@ -0,0 +1,28 @@
+package db
+
+import "testing"
+
+func TestRequeueRefusesLateReport(t *testing.T) {
+	db := newTestDB(t, nil)
+	insertTask(t, db, "t1")
+	late := acquire(t, db, "w1")
+
+	if _, err := db.RequeueTask("t1", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.UpdateTask(late, StateDone, "", nil, nil); ErrorKind(err) != KindConflict {
+		t.Fatalf("late report after requeue: %v, expected a conflict", err)
+	}
+
+	current := acquire(t, db, "w2")
+	if _, err := db.UpdateTask(late, StateDone, "", nil, nil); ErrorKind(err) != KindConflict {
+		t.Fatalf("late report after re-acquire: %v, expected a conflict", err)
+	}
+	task, err := db.UpdateTask(current, StateDone, "ok", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.State != StateDone || task.Worker != "w2" {
+		t.Errorf("task state %d, worker %s; expected done by w2", task.State, task.Worker)
+	}
+}
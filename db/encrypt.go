@@ -0,0 +1,328 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/boiler/ciri/config"
+)
+
+// ErrKeyMissing is returned for encrypted data when no key is configured.
+var ErrKeyMissing = errors.New("data is encrypted, but no encryption key is configured")
+
+// An encrypted stream is the magic, the key id and a nonce prefix followed by
+// chunks of a flag byte, the length and the sealed data. The nonce of a chunk
+// is the prefix, the chunk number and the flag, which marks the last chunk, so
+// that reordered or truncated streams fail. A blob is the magic, the key id,
+// the nonce and the sealed data.
+const (
+	encStreamMagic = "ciriENC\x01"
+	encBlobMagic   = "ciriENC\x02"
+	encChunkSize   = 64 << 10
+	keyIdSize      = 4
+	noncePrefix    = 7
+)
+
+type key struct {
+	id   [keyIdSize]byte
+	aead cipher.AEAD
+}
+
+// Keys encrypt with the first key and decrypt with any of them. Nil Keys
+// leave the data as is, but refuse to decrypt.
+type Keys struct {
+	keys []*key
+}
+
+// LoadKeys reads the keys of cfg, nil cfg disables the encryption.
+func LoadKeys(cfg *config.ConfigEncryption) (*Keys, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.KeyFile != "" && cfg.KeyEnv != "" {
+		return nil, fmt.Errorf("encryption: only one of key_file and key_env possible")
+	}
+	sources := []string{}
+	if cfg.KeyFile != "" {
+		sources = append(sources, "file "+cfg.KeyFile)
+	} else if cfg.KeyEnv != "" {
+		sources = append(sources, "env "+cfg.KeyEnv)
+	} else {
+		return nil, fmt.Errorf("encryption: key_file or key_env required")
+	}
+	for _, path := range cfg.OldKeyFiles {
+		sources = append(sources, "file "+path)
+	}
+	for _, name := range cfg.OldKeyEnvs {
+		sources = append(sources, "env "+name)
+	}
+
+	keys := &Keys{}
+	for _, source := range sources {
+		kind, name, _ := strings.Cut(source, " ")
+		var value string
+		if kind == "file" {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("encryption key: %s", err)
+			}
+			value = string(data)
+		} else {
+			value = os.Getenv(name)
+			if value == "" {
+				return nil, fmt.Errorf("encryption key: environment variable %s not set", name)
+			}
+		}
+		raw, err := ParseKey(value)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %s", name, err)
+		}
+		k, err := newKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		keys.keys = append(keys.keys, k)
+	}
+	return keys, nil
+}
+
+// ParseKey decodes a hex or base64 encoded 32 byte key.
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("32 bytes hex or base64 encoded key required")
+	}
+	return raw, nil
+}
+
+func newKey(raw []byte) (*key, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &key{aead: aead}
+	sum := sha256.Sum256(raw)
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+func (ks *Keys) find(id []byte) (*key, error) {
+	if ks == nil {
+		return nil, ErrKeyMissing
+	}
+	for _, k := range ks.keys {
+		if bytes.Equal(k.id[:], id) {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("data is encrypted with an unknown key %x", id)
+}
+
+// Writer returns a writer encrypting into w, Close writes the last chunk
+// but doesn't close w. With nil Keys the writer passes the data through.
+func (ks *Keys) Writer(w io.Writer) (io.WriteCloser, error) {
+	if ks == nil {
+		return nopCloser{w}, nil
+	}
+	k := ks.keys[0]
+	ew := &encWriter{w: w, key: k, buf: make([]byte, 0, encChunkSize)}
+	if _, err := rand.Read(ew.prefix[:]); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encStreamMagic), k.id[:]...)
+	if _, err := w.Write(append(header, ew.prefix[:]...)); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+// Reader returns a reader decrypting r if it is an encrypted stream, plain
+// streams are returned as is.
+func (ks *Keys) Reader(r *bufio.Reader) (io.Reader, error) {
+	magic, err := r.Peek(len(encStreamMagic))
+	if err != nil || string(magic) != encStreamMagic {
+		return r, nil
+	}
+	header := make([]byte, len(encStreamMagic)+keyIdSize+noncePrefix)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("encrypted stream: %s", err)
+	}
+	k, err := ks.find(header[len(encStreamMagic) : len(encStreamMagic)+keyIdSize])
+	if err != nil {
+		return nil, err
+	}
+	er := &encReader{r: r, key: k}
+	copy(er.prefix[:], header[len(encStreamMagic)+keyIdSize:])
+	return er, nil
+}
+
+// Seal encrypts a single blob, nil Keys return it as is.
+func (ks *Keys) Seal(data []byte) ([]byte, error) {
+	if ks == nil {
+		return data, nil
+	}
+	k := ks.keys[0]
+	out := append([]byte(encBlobMagic), k.id[:]...)
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return k.aead.Seal(out, nonce, data, []byte(encBlobMagic)), nil
+}
+
+// Open decrypts a blob of Seal, plain blobs are returned as is.
+func (ks *Keys) Open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(encBlobMagic)) {
+		return data, nil
+	}
+	data = data[len(encBlobMagic):]
+	if len(data) < keyIdSize {
+		return nil, fmt.Errorf("encrypted blob truncated")
+	}
+	k, err := ks.find(data[:keyIdSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[keyIdSize:]
+	if len(data) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted blob truncated")
+	}
+	nonce := data[:k.aead.NonceSize()]
+	return k.aead.Open(nil, nonce, data[k.aead.NonceSize():], []byte(encBlobMagic))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+type encWriter struct {
+	w      io.Writer
+	key    *key
+	prefix [noncePrefix]byte
+	chunk  uint32
+	buf    []byte
+}
+
+func chunkNonce(prefix [noncePrefix]byte, chunk uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix[:])
+	binary.BigEndian.PutUint32(nonce[noncePrefix:], chunk)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func (ew *encWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.flush(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (ew *encWriter) flush(last bool) error {
+	if ew.chunk == ^uint32(0) {
+		return fmt.Errorf("encrypted stream too long")
+	}
+	sealed := ew.key.aead.Seal(nil, chunkNonce(ew.prefix, ew.chunk, last), ew.buf, nil)
+	ew.chunk++
+	ew.buf = ew.buf[:0]
+	header := make([]byte, 5)
+	if last {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err := ew.w.Write(header); err != nil {
+		return err
+	}
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+func (ew *encWriter) Close() error {
+	return ew.flush(true)
+}
+
+type encReader struct {
+	r      io.Reader
+	key    *key
+	prefix [noncePrefix]byte
+	chunk  uint32
+	buf    []byte
+	last   bool
+}
+
+func (er *encReader) Read(p []byte) (int, error) {
+	for len(er.buf) == 0 {
+		if er.last {
+			return 0, io.EOF
+		}
+		if err := er.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.buf)
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+func (er *encReader) next() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(er.r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("encrypted stream truncated")
+		}
+		return err
+	}
+	last := header[0] == 1
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > encChunkSize+uint32(er.key.aead.Overhead()) {
+		return fmt.Errorf("encrypted stream: bad chunk size %d", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(er.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("encrypted stream truncated")
+		}
+		return err
+	}
+	plain, err := er.key.aead.Open(nil, chunkNonce(er.prefix, er.chunk, last), sealed, nil)
+	if err != nil {
+		return fmt.Errorf("encrypted stream: chunk %d: %s", er.chunk, err)
+	}
+	er.chunk++
+	er.buf, er.last = plain, last
+	return nil
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boiler/ciri/config"
+)
+
+// writeKey writes a new random key into the dir and returns its path.
+func writeKey(t *testing.T, dir string, name string) string {
+	t.Helper()
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(raw)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func snapshotDB(t *testing.T, path string, enc *config.ConfigEncryption) *DB {
+	t.Helper()
+	return newTestDB(t, &config.Config{SnapshotPath: path, Encryption: enc})
+}
+
+// body is long enough for the snapshot to span several chunks.
+var body = strings.Repeat("secret body ", 200)
+
+// writeTestSnapshot writes a snapshot of 100 tasks with db.
+func writeTestSnapshot(t *testing.T, db *DB) {
+	t.Helper()
+	tasks := []*Task{}
+	for i := 0; i < 100; i++ {
+		task := db.EmptyTask()
+		task.Id = fmt.Sprintf("t%d", i)
+		task.Body = body
+		tasks = append(tasks, &task)
+	}
+	if err := db.InsertTasks(tasks); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.WriteSnapshot(db.cfg.SnapshotPath); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkLoaded fails unless db holds the tasks of writeTestSnapshot.
+func checkLoaded(t *testing.T, db *DB) {
+	t.Helper()
+	tasks, _, err := db.QueryTasks(&Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 100 {
+		t.Fatalf("%d tasks loaded, expected 100", len(tasks))
+	}
+	for _, task := range tasks {
+		if task.Body != body {
+			t.Fatalf("task %s: body not restored", task.Id)
+		}
+	}
+}
+
+func TestSnapshotEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot")
+	enc := &config.ConfigEncryption{KeyFile: writeKey(t, dir, "key")}
+	writeTestSnapshot(t, snapshotDB(t, path, enc))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(encStreamMagic)) {
+		t.Error("snapshot not encrypted")
+	}
+	if bytes.Contains(data, []byte("secret body")) {
+		t.Error("plain task body in the encrypted snapshot")
+	}
+	if len(data) < 2*encChunkSize {
+		t.Errorf("snapshot of %d bytes, expected several chunks", len(data))
+	}
+
+	db := snapshotDB(t, path, enc)
+	if err := db.ReadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	checkLoaded(t, db)
+}
+
+func TestSnapshotKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot")
+	oldKey, newKey := writeKey(t, dir, "old"), writeKey(t, dir, "new")
+	writeTestSnapshot(t, snapshotDB(t, path, &config.ConfigEncryption{KeyFile: oldKey}))
+
+	rotated := &config.ConfigEncryption{KeyFile: newKey, OldKeyFiles: []string{oldKey}}
+	db := snapshotDB(t, path, rotated)
+	if err := db.ReadSnapshot(path); err != nil {
+		t.Fatalf("snapshot of the old key: %s", err)
+	}
+	checkLoaded(t, db)
+
+	// the next snapshot is written with the new key only
+	if err := db.WriteSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	db = snapshotDB(t, path, &config.ConfigEncryption{KeyFile: newKey})
+	if err := db.ReadSnapshot(path); err != nil {
+		t.Fatalf("snapshot after the rotation: %s", err)
+	}
+	checkLoaded(t, db)
+}
+
+func TestSnapshotWrongKey(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot")
+	writeTestSnapshot(t, snapshotDB(t, path, &config.ConfigEncryption{KeyFile: writeKey(t, dir, "key")}))
+
+	for _, tc := range []struct {
+		name     string
+		enc      *config.ConfigEncryption
+		expected string
+	}{
+		{"wrong key", &config.ConfigEncryption{KeyFile: writeKey(t, dir, "other")}, "encrypted with an unknown key"},
+		{"no key", nil, ErrKeyMissing.Error()},
+	} {
+		db := snapshotDB(t, path, tc.enc)
+		err := db.ReadSnapshot(path)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s: error %v, expected %q", tc.name, err, tc.expected)
+		}
+	}
+}
+
+func TestSnapshotTampered(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot")
+	enc := &config.ConfigEncryption{KeyFile: writeKey(t, dir, "key")}
+	writeTestSnapshot(t, snapshotDB(t, path, enc))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(encStreamMagic) + keyIdSize + noncePrefix
+	firstChunk := header + 5 + encChunkSize + 16
+
+	flipped := bytes.Clone(data)
+	flipped[header+100] ^= 1
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"flipped bit", flipped, "chunk 0"},
+		{"truncated chunk", data[:len(data)-10], "truncated"},
+		{"missing last chunk", data[:firstChunk], "truncated"},
+		{"header only", data[:header], "truncated"},
+	} {
+		bad := filepath.Join(dir, "bad")
+		if err := os.WriteFile(bad, tc.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		db := snapshotDB(t, bad, enc)
+		err := db.ReadSnapshot(bad)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("%s: error %v, expected %q", tc.name, err, tc.expected)
+		}
+		if task, _ := db.GetTask("id", "t0"); task != nil {
+			t.Errorf("%s: tasks loaded from a rejected snapshot", tc.name)
+		}
+	}
+}
+
+func TestSnapshotPlain(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "snapshot")
+	writeTestSnapshot(t, snapshotDB(t, path, nil))
+
+	db := snapshotDB(t, path, &config.ConfigEncryption{KeyFile: writeKey(t, dir, "key")})
+	if err := db.ReadSnapshot(path); err != nil {
+		t.Fatalf("plain snapshot: %s", err)
+	}
+	checkLoaded(t, db)
+}
+
+func TestBlobTampered(t *testing.T) {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	k, err := newKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &Keys{keys: []*key{k}}
+	sealed, err := ks.Seal([]byte("entry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := ks.Open(sealed); err != nil || string(plain) != "entry" {
+		t.Fatalf("open: %q, %v", plain, err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	if _, err := ks.Open(sealed); err == nil {
+		t.Error("tampered blob opened")
+	}
+	if _, err := ks.Open(sealed[:len(encBlobMagic)+2]); err == nil {
+		t.Error("truncated blob opened")
+	}
+	if _, err := (*Keys)(nil).Open(sealed); err != ErrKeyMissing {
+		t.Errorf("blob without keys: %v", err)
+	}
+}
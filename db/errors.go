@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of the db errors, the API maps them to http statuses.
+const (
+	KindNotFound    = "not_found"
+	KindConflict    = "conflict"
+	KindForbidden   = "forbidden"
+	KindTooLarge    = "too_large"
+	KindUnavailable = "unavailable"
+)
+
+// Error is an error of a known kind, the message is kept as is.
+type Error struct {
+	Kind string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func errorf(kind string, format string, args ...interface{}) error {
+	return &Error{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ErrorKind returns the kind of err, empty for other errors.
+func ErrorKind(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ""
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+)
+
+type Event struct {
+	Id   uint64 `json:"id"`
+	Time uint64 `json:"time"`
+	Type string `json:"type"` // insert, acquire, update, done, error, refuse, cancel, release, requeue, edit, import, delete, ...
+	Task *Task  `json:"task,omitempty"`
+
+	// set instead of Task for group_complete, which only goes to the
+	// configured webhook of the group
+	Group   *GroupStatus `json:"group,omitempty"`
+	Webhook string       `json:"webhook,omitempty"`
+}
+
+// EventLog keeps the latest task events in a ring buffer, so that
+// subscribers reconnecting with the last seen id don't miss events.
+type EventLog struct {
+	mutex sync.Mutex
+	ring  []*Event
+	next  uint64 // id of the next event, ids start from 1
+	subs  map[chan struct{}]struct{}
+}
+
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &EventLog{
+		ring: make([]*Event, size),
+		next: 1,
+		subs: make(map[chan struct{}]struct{}),
+	}
+}
+
+func (l *EventLog) publish(events []*Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, e := range events {
+		e.Id = l.next
+		l.ring[e.Id%uint64(len(l.ring))] = e
+		l.next++
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Since returns events after the given id. overflow is set when some of
+// them already left the buffer, or when the id is from before a restart, as
+// the ids start from 1 again; the buffered events are returned then.
+func (l *EventLog) Since(id uint64) (events []*Event, overflow bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	size := uint64(len(l.ring))
+	first := id + 1
+	if first > l.next {
+		first = 1
+		overflow = true
+	}
+	if l.next > size && first < l.next-size {
+		first = l.next - size
+		overflow = true
+	}
+	for i := first; i < l.next; i++ {
+		events = append(events, l.ring[i%size])
+	}
+	return events, overflow
+}
+
+// LastId returns the id of the latest event.
+func (l *EventLog) LastId() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.next - 1
+}
+
+// Subscribe returns a channel signalled after new events are published and
+// a function to cancel the subscription.
+func (l *EventLog) Subscribe() (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	l.mutex.Lock()
+	l.subs[ch] = struct{}{}
+	l.mutex.Unlock()
+	return ch, func() {
+		l.mutex.Lock()
+		delete(l.subs, ch)
+		l.mutex.Unlock()
+	}
+}
+
+func (db *DB) Events() *EventLog {
+	return db.events
+}
+
+// emitEvent queues the event until the transaction commits.
+func (db *DB) emitEvent(txn *memdb.Txn, eventType string, task *Task) {
+	db.pendingEvents = append(db.pendingEvents, &Event{
+		Time: uint64(time.Now().Unix()),
+		Type: eventType,
+		Task: task,
+	})
+}
+
+// emitGroupEvent queues the group_complete event for the webhook url.
+func (db *DB) emitGroupEvent(txn *memdb.Txn, url string, status *GroupStatus) {
+	db.pendingEvents = append(db.pendingEvents, &Event{
+		Time:    uint64(time.Now().Unix()),
+		Type:    "group_complete",
+		Group:   status,
+		Webhook: url,
+	})
+}
+
+func eventType(action string, task *Task) string {
+	if action != "update" {
+		return action
+	}
+	switch task.State {
+	case StateDone:
+		return "done"
+	case StateError:
+		return "error"
+	case StateCancelled:
+		return "cancel"
+	case StateNew:
+		return "refuse"
+	}
+	return "update"
+}
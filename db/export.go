@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/boiler/ciri/metrics"
+)
+
+// ExportTasks calls fn for every task matching the filter. All tasks come
+// from a single read transaction, so the export is consistent while writers
+// go on.
+func (db *DB) ExportTasks(f *Filter, fn func(*Task) error) error {
+	txn := db.memdb.Txn(false)
+	defer txn.Abort()
+	return f.Each(txn, fn)
+}
+
+// Conflict modes of ImportTasks for ids that already exist.
+const (
+	ImportFail    = "fail"
+	ImportSkip    = "skip"
+	ImportReplace = "replace"
+)
+
+type ImportResult struct {
+	Inserted int `json:"inserted"`
+	Replaced int `json:"replaced"`
+	Skipped  int `json:"skipped"`
+}
+
+// ImportTasks stores the tasks as is, keeping ids, states, workers and
+// timestamps, unlike InsertTasks. Dependencies are not resolved again. The
+// import is a single transaction, with ImportFail nothing is stored if any
+// of the ids exists. With ImportReplace the replaced tasks must pass allows,
+// if it is not nil.
+func (db *DB) ImportTasks(tasks []*Task, conflict string, allows func(*Task) bool) (*ImportResult, error) {
+	switch conflict {
+	case "":
+		conflict = ImportFail
+	case ImportFail, ImportSkip, ImportReplace:
+	default:
+		return nil, fmt.Errorf("bad conflict mode: %s", conflict)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	res := &ImportResult{}
+	ids := make(map[string]bool)
+	for _, t := range tasks {
+		if t.Id == "" {
+			return nil, fmt.Errorf("task id required")
+		}
+		if ids[t.Id] {
+			return nil, fmt.Errorf("duplicate task id: %s", t.Id)
+		}
+		ids[t.Id] = true
+		if t.State < StateNew || t.State > StateBlocked {
+			return nil, fmt.Errorf("task %s: bad state: %d", t.Id, t.State)
+		}
+		if t.Sticker == "" {
+			t.Sticker = "default"
+		}
+		if t.Pool == "" {
+			t.Pool = "default"
+		}
+		if t.Version == 0 {
+			t.Version = 1
+		}
+
+		r, err := txn.First("tasks", "id", t.Id)
+		if err != nil {
+			return nil, err
+		}
+		from := t.State
+		if r != nil {
+			old := r.(*Task)
+			switch conflict {
+			case ImportFail:
+				return nil, errorf(KindConflict, "task already exists: %s", t.Id)
+			case ImportSkip:
+				res.Skipped++
+				continue
+			}
+			if allows != nil && !allows(old) {
+				return nil, errorf(KindForbidden, "task %s: existing task out of scope", t.Id)
+			}
+			from = old.State
+			res.Replaced++
+			db.onCommit(func() {
+				metrics.GaugeDec("tasks_count", old.Sticker, old.Priority, old.Pool, old.State)
+			})
+		} else {
+			res.Inserted++
+		}
+
+		if err := txn.Insert("tasks", t); err != nil {
+			return nil, err
+		}
+		if err := db.recordTransition(txn, "import", from, t); err != nil {
+			return nil, err
+		}
+		db.onCommit(func() {
+			metrics.GaugeInc("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
+		})
+	}
+	if err := db.commit(txn); err != nil {
+		return nil, err
+	}
+	log.Printf("tasks imported: %d inserted, %d replaced, %d skipped", res.Inserted, res.Replaced, res.Skipped)
+	return res, nil
+}
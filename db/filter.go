@@ -0,0 +1,351 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+)
+
+// Filter selects tasks by any combination of fields. Zero values match all.
+type Filter struct {
+	States        []int  `json:"states,omitempty"`
+	Pool          string `json:"pool,omitempty"`
+	Sticker       string `json:"sticker,omitempty"`
+	Worker        string `json:"worker,omitempty"`
+	PriorityMin   *int   `json:"priority_min,omitempty"`
+	PriorityMax   *int   `json:"priority_max,omitempty"`
+	AddedAfter    uint64 `json:"added_after,omitempty"`
+	AddedBefore   uint64 `json:"added_before,omitempty"`
+	UpdatedAfter  uint64 `json:"updated_after,omitempty"`
+	UpdatedBefore uint64 `json:"updated_before,omitempty"`
+}
+
+type Query struct {
+	Filter
+	Order  string // added, updated or priority, "-" prefix for descending
+	Limit  int
+	Cursor string
+}
+
+type queryCursor struct {
+	Order string `json:"o"`
+	Key   int64  `json:"k"`
+	Id    string `json:"id"`
+}
+
+// ParseFilter reads the filter from url query values. Time bounds are unix
+// timestamps or durations relative to now, e.g. added_before=1h.
+func ParseFilter(q url.Values) (*Filter, error) {
+	f := &Filter{
+		Pool:    q.Get("pool"),
+		Sticker: q.Get("sticker"),
+		Worker:  q.Get("worker"),
+	}
+	if v := q.Get("state"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			state, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad state: %s", s)
+			}
+			f.States = append(f.States, state)
+		}
+	}
+	for _, p := range []struct {
+		name string
+		v    **int
+	}{
+		{"priority_min", &f.PriorityMin},
+		{"priority_max", &f.PriorityMax},
+	} {
+		if v := q.Get(p.name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s: %s", p.name, v)
+			}
+			*p.v = &i
+		}
+	}
+	for _, p := range []struct {
+		name string
+		v    *uint64
+	}{
+		{"added_after", &f.AddedAfter},
+		{"added_before", &f.AddedBefore},
+		{"updated_after", &f.UpdatedAfter},
+		{"updated_before", &f.UpdatedBefore},
+	} {
+		if v := q.Get(p.name); v != "" {
+			ts, err := parseTime(v)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s: %s", p.name, v)
+			}
+			*p.v = ts
+		}
+	}
+	return f, nil
+}
+
+// Values encodes the filter as url query values understood by ParseFilter.
+func (f *Filter) Values() url.Values {
+	q := url.Values{}
+	if len(f.States) > 0 {
+		states := make([]string, len(f.States))
+		for i, s := range f.States {
+			states[i] = strconv.Itoa(s)
+		}
+		q.Set("state", strings.Join(states, ","))
+	}
+	for k, v := range map[string]string{"pool": f.Pool, "sticker": f.Sticker, "worker": f.Worker} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if f.PriorityMin != nil {
+		q.Set("priority_min", strconv.Itoa(*f.PriorityMin))
+	}
+	if f.PriorityMax != nil {
+		q.Set("priority_max", strconv.Itoa(*f.PriorityMax))
+	}
+	for k, v := range map[string]uint64{
+		"added_after":    f.AddedAfter,
+		"added_before":   f.AddedBefore,
+		"updated_after":  f.UpdatedAfter,
+		"updated_before": f.UpdatedBefore,
+	} {
+		if v != 0 {
+			q.Set(k, strconv.FormatUint(v, 10))
+		}
+	}
+	return q
+}
+
+func parseTime(v string) (uint64, error) {
+	if ts, err := strconv.ParseUint(v, 10, 64); err == nil {
+		return ts, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(time.Now().Add(-d).Unix()), nil
+}
+
+func (f *Filter) IsEmpty() bool {
+	return len(f.States) == 0 && f.Pool == "" && f.Sticker == "" && f.Worker == "" &&
+		f.PriorityMin == nil && f.PriorityMax == nil &&
+		f.AddedAfter == 0 && f.AddedBefore == 0 && f.UpdatedAfter == 0 && f.UpdatedBefore == 0
+}
+
+func (f *Filter) Match(t *Task) bool {
+	if len(f.States) > 0 {
+		found := false
+		for _, s := range f.States {
+			if t.State == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Pool != "" && t.Pool != f.Pool {
+		return false
+	}
+	if f.Sticker != "" && t.Sticker != f.Sticker {
+		return false
+	}
+	if f.Worker != "" && t.Worker != f.Worker {
+		return false
+	}
+	if f.PriorityMin != nil && t.Priority < *f.PriorityMin {
+		return false
+	}
+	if f.PriorityMax != nil && t.Priority > *f.PriorityMax {
+		return false
+	}
+	if f.AddedAfter != 0 && t.Added < f.AddedAfter {
+		return false
+	}
+	if f.AddedBefore != 0 && t.Added > f.AddedBefore {
+		return false
+	}
+	if f.UpdatedAfter != 0 && t.Updated < f.UpdatedAfter {
+		return false
+	}
+	if f.UpdatedBefore != 0 && t.Updated > f.UpdatedBefore {
+		return false
+	}
+	return true
+}
+
+// iterators picks the most selective index for the filter.
+func (f *Filter) iterators(txn *memdb.Txn) ([]memdb.ResultIterator, error) {
+	var it memdb.ResultIterator
+	var err error
+	switch {
+	case f.Sticker != "":
+		it, err = txn.Get("tasks", "sticker", f.Sticker)
+	case f.Worker != "":
+		it, err = txn.Get("tasks", "worker", f.Worker)
+	case f.Pool != "":
+		it, err = txn.Get("tasks", "pool", f.Pool)
+	case len(f.States) > 0:
+		its := []memdb.ResultIterator{}
+		for _, s := range f.States {
+			it, err := txn.Get("tasks", "state", s)
+			if err != nil {
+				return nil, err
+			}
+			its = append(its, it)
+		}
+		return its, nil
+	case f.AddedAfter != 0:
+		it, err = txn.LowerBound("tasks", "added", f.AddedAfter, "")
+	case f.UpdatedAfter != 0:
+		it, err = txn.LowerBound("tasks", "updated", f.UpdatedAfter, "")
+	default:
+		it, err = txn.Get("tasks", "id")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []memdb.ResultIterator{it}, nil
+}
+
+// Each calls fn for every task matching the filter within txn.
+func (f *Filter) Each(txn *memdb.Txn, fn func(*Task) error) error {
+	its, err := f.iterators(txn)
+	if err != nil {
+		return err
+	}
+	for _, it := range its {
+		for obj := it.Next(); obj != nil; obj = it.Next() {
+			t := obj.(*Task)
+			if !f.Match(t) {
+				continue
+			}
+			if err := fn(t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func orderKey(order string, t *Task) int64 {
+	switch strings.TrimPrefix(order, "-") {
+	case "updated":
+		return int64(t.Updated)
+	case "priority":
+		return int64(t.Priority)
+	}
+	return int64(t.Added)
+}
+
+// QueryTasks returns a page of tasks matching the query and the cursor of the
+// next page, empty on the last one.
+func (db *DB) QueryTasks(q *Query) ([]*Task, string, error) {
+	if q.Order == "" {
+		q.Order = "added"
+	}
+	switch strings.TrimPrefix(q.Order, "-") {
+	case "added", "updated", "priority":
+	default:
+		return nil, "", fmt.Errorf("bad order: %s", q.Order)
+	}
+	desc := strings.HasPrefix(q.Order, "-")
+	var after *queryCursor
+	if q.Cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("bad cursor")
+		}
+		after = &queryCursor{}
+		if err := json.Unmarshal(b, after); err != nil {
+			return nil, "", fmt.Errorf("bad cursor")
+		}
+		if after.Order != q.Order {
+			return nil, "", fmt.Errorf("cursor does not match order")
+		}
+	}
+	return db.queryIndex(db.memdb.Txn(false), q, strings.TrimPrefix(q.Order, "-"), desc, after)
+}
+
+// queryIndex walks the index of the order from the cursor, or from the bound
+// of the filter on the ordered field, until the page is full.
+func (db *DB) queryIndex(txn *memdb.Txn, q *Query, index string, desc bool, after *queryCursor) ([]*Task, string, error) {
+	var lower, upper *int64
+	timeBound := func(v uint64) *int64 {
+		if v == 0 {
+			return nil
+		}
+		k := int64(v)
+		return &k
+	}
+	// arg converts an order key to the type of the indexed field
+	arg := func(k int64) interface{} { return uint64(k) }
+	switch index {
+	case "added":
+		lower, upper = timeBound(q.AddedAfter), timeBound(q.AddedBefore)
+	case "updated":
+		lower, upper = timeBound(q.UpdatedAfter), timeBound(q.UpdatedBefore)
+	case "priority":
+		arg = func(k int64) interface{} { return int(k) }
+		if q.PriorityMin != nil {
+			k := int64(*q.PriorityMin)
+			lower = &k
+		}
+		if q.PriorityMax != nil {
+			k := int64(*q.PriorityMax)
+			upper = &k
+		}
+	}
+	var it memdb.ResultIterator
+	var err error
+	switch {
+	case after != nil && desc:
+		it, err = txn.ReverseLowerBound("tasks", index, arg(after.Key), after.Id)
+	case after != nil:
+		it, err = txn.LowerBound("tasks", index, arg(after.Key), after.Id)
+	case desc && upper != nil:
+		it, err = txn.ReverseLowerBound("tasks", index, arg(*upper+1), "")
+	case desc:
+		it, err = txn.GetReverse("tasks", index+"_prefix")
+	case lower != nil:
+		it, err = txn.LowerBound("tasks", index, arg(*lower), "")
+	default:
+		it, err = txn.Get("tasks", index+"_prefix")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	tasks := []*Task{}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		t := obj.(*Task)
+		key := orderKey(q.Order, t)
+		if after != nil && key == after.Key && t.Id == after.Id {
+			continue
+		}
+		// past the bound in the order of the walk, no more matches
+		if !desc && upper != nil && key > *upper || desc && lower != nil && key < *lower {
+			break
+		}
+		if !q.Filter.Match(t) {
+			continue
+		}
+		if q.Limit > 0 && len(tasks) == q.Limit {
+			last := tasks[len(tasks)-1]
+			b, _ := json.Marshal(queryCursor{q.Order, orderKey(q.Order, last), last.Id})
+			return tasks, base64.RawURLEncoding.EncodeToString(b), nil
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, "", nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestQueryPaging compares the pages of every order with the sorted matches.
+func TestQueryPaging(t *testing.T) {
+	db := newTestDB(t, nil)
+	rnd := rand.New(rand.NewSource(1))
+	tasks := []*Task{}
+	for i := 0; i < 300; i++ {
+		tasks = append(tasks, &Task{
+			Id:       fmt.Sprintf("t%03d", rnd.Intn(1000)*1000+i),
+			Pool:     []string{"a", "b"}[rnd.Intn(2)],
+			Priority: rnd.Intn(11) - 5,
+			Added:    uint64(1000 + rnd.Intn(20)),
+			Updated:  uint64(2000 + rnd.Intn(20)),
+		})
+	}
+	if _, err := db.ImportTasks(tasks, ImportFail, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	byId := make(map[string]*Task)
+	for _, task := range tasks {
+		byId[task.Id] = task
+	}
+
+	one, three := 1, 3
+	minusTwo := -2
+	filters := []Filter{
+		{},
+		{Pool: "a"},
+		{AddedAfter: 1005, AddedBefore: 1012},
+		{UpdatedAfter: 2003, UpdatedBefore: 2010, Pool: "b"},
+		{PriorityMin: &minusTwo, PriorityMax: &three},
+		{PriorityMin: &one, Pool: "a"},
+		{PriorityMax: &minusTwo},
+	}
+	for _, order := range []string{"added", "-added", "updated", "-updated", "priority", "-priority"} {
+		desc := strings.HasPrefix(order, "-")
+		for _, f := range filters {
+			expected := []string{}
+			for _, task := range tasks {
+				if f.Match(task) {
+					expected = append(expected, task.Id)
+				}
+			}
+			sort.Slice(expected, func(i, j int) bool {
+				ki, kj := orderKey(order, byId[expected[i]]), orderKey(order, byId[expected[j]])
+				if ki != kj {
+					return (ki < kj) != desc
+				}
+				return (expected[i] < expected[j]) != desc
+			})
+			for _, limit := range []int{0, 1, 7, 100} {
+				got := []string{}
+				cursor := ""
+				for pages := 0; pages <= len(tasks); pages++ {
+					page, next, err := db.QueryTasks(&Query{Filter: f, Order: order, Limit: limit, Cursor: cursor})
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, task := range page {
+						got = append(got, task.Id)
+					}
+					if next == "" {
+						break
+					}
+					cursor = next
+				}
+				if !reflect.DeepEqual(got, expected) {
+					t.Errorf("order %s, filter %+v, limit %d: %d tasks, expected %d", order, f, limit, len(got), len(expected))
+				}
+			}
+		}
+	}
+}
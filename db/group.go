@@ -0,0 +1,214 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-memdb"
+)
+
+type Group struct {
+	Id         string       `json:"id"`
+	OnComplete *GroupAction `json:"on_complete,omitempty"`
+	Added      uint64       `json:"added"`
+	Completed  uint64       `json:"completed,omitempty"`
+}
+
+// GroupAction is run once all tasks of a group reach a terminal state:
+// Task is inserted as a follow-up task and Webhook, the url of a configured
+// webhook, receives the group_complete event with the group status.
+type GroupAction struct {
+	Task    *Task  `json:"task,omitempty"`
+	Webhook string `json:"webhook,omitempty"`
+}
+
+type GroupStatus struct {
+	Id        string      `json:"id"`
+	Total     int         `json:"total"`
+	Finished  int         `json:"finished"`
+	Progress  float64     `json:"progress"` // percent of finished tasks
+	States    map[int]int `json:"states"`
+	Completed uint64      `json:"completed,omitempty"`
+}
+
+// InsertGroup inserts the tasks as members of group g, creating the group or
+// adding to an existing one.
+func (db *DB) InsertGroup(g *Group, tasks []*Task) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	if err := db.checkWebhook(g.OnComplete); err != nil {
+		return err
+	}
+	if g.Id == "" {
+		g.Id = uuid.NewString()
+	}
+	group := *g // copy required for update
+	r, err := txn.First("groups", "id", g.Id)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		if g.OnComplete == nil {
+			group.OnComplete = r.(*Group).OnComplete
+		}
+		group.Added = r.(*Group).Added
+	} else {
+		group.Added = uint64(time.Now().Unix())
+	}
+	group.Completed = 0
+	if err := txn.Insert("groups", &group); err != nil {
+		return err
+	}
+
+	for _, t := range tasks {
+		t.Group = g.Id
+	}
+	if err := db.insertTasks(txn, tasks); err != nil {
+		return err
+	}
+	// members may be inserted already finished, e.g. on failed dependencies
+	if err := db.checkGroup(txn, g.Id); err != nil {
+		return err
+	}
+	if err := db.commit(txn); err != nil {
+		return err
+	}
+	*g = group
+	log.Printf("group %s: %d tasks inserted", g.Id, len(tasks))
+	return nil
+}
+
+func (db *DB) GetGroupStatus(id string) (*GroupStatus, error) {
+	txn := db.memdb.Txn(false)
+	return groupStatus(txn, id)
+}
+
+func groupStatus(txn *memdb.Txn, id string) (*GroupStatus, error) {
+	status := &GroupStatus{
+		Id:     id,
+		States: make(map[int]int),
+	}
+	r, err := txn.First("groups", "id", id)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		status.Completed = r.(*Group).Completed
+	}
+	it, err := txn.Get("tasks", "group", id)
+	if err != nil {
+		return nil, err
+	}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		t := obj.(*Task)
+		status.Total++
+		status.States[t.State]++
+		if t.Finished() {
+			status.Finished++
+		}
+	}
+	if r == nil && status.Total == 0 {
+		return nil, nil
+	}
+	if status.Total > 0 {
+		status.Progress = float64(status.Finished) * 100 / float64(status.Total)
+	}
+	return status, nil
+}
+
+// checkGroup marks the group completed and runs its completion action when
+// the last member task has finished.
+func (db *DB) checkGroup(txn *memdb.Txn, id string) error {
+	if id == "" {
+		return nil
+	}
+	r, err := txn.First("groups", "id", id)
+	if err != nil {
+		return err
+	}
+	if r == nil || r.(*Group).Completed != 0 {
+		return nil
+	}
+	status, err := groupStatus(txn, id)
+	if err != nil {
+		return err
+	}
+	if status.Finished < status.Total {
+		return nil
+	}
+
+	group := *r.(*Group) // copy required for update
+	group.Completed = uint64(time.Now().Unix())
+	if err := txn.Insert("groups", &group); err != nil {
+		return err
+	}
+	status.Completed = group.Completed
+	db.onCommit(func() {
+		log.Printf("group %s completed: %d tasks", group.Id, status.Total)
+	})
+	if group.OnComplete == nil {
+		return nil
+	}
+	if group.OnComplete.Task != nil {
+		task := *group.OnComplete.Task // copy, the action may run again if the group grows
+		if task.Group == group.Id {
+			task.Group = ""
+		}
+		exists := false
+		if task.Id != "" {
+			r, err := txn.First("tasks", "id", task.Id)
+			if err != nil {
+				return err
+			}
+			exists = r != nil
+		}
+		if exists {
+			db.onCommit(func() {
+				log.Printf("group %s: follow-up task %s already exists", group.Id, task.Id)
+			})
+		} else if err := db.insertTasks(txn, []*Task{&task}); err != nil {
+			// a broken follow-up must not fail the update of the last member
+			db.onCommit(func() {
+				log.Printf("group %s: follow-up task: %s", group.Id, err)
+			})
+		}
+	}
+	if group.OnComplete.Webhook != "" {
+		db.emitGroupEvent(txn, group.OnComplete.Webhook, status)
+	}
+	return nil
+}
+
+// checkWebhook allows only the urls of the configured webhooks, so that
+// clients can't make the server post to arbitrary addresses.
+func (db *DB) checkWebhook(a *GroupAction) error {
+	if a == nil || a.Webhook == "" {
+		return nil
+	}
+	for _, wh := range db.cfg.Webhook {
+		if wh.Url == a.Webhook {
+			return nil
+		}
+	}
+	return fmt.Errorf("on_complete.webhook is not a configured webhook: %s", a.Webhook)
+}
+
+// reopenGroup clears the completion mark after a member was put back to work,
+// the completion action runs again once it finishes.
+func reopenGroup(txn *memdb.Txn, id string) error {
+	r, err := txn.First("groups", "id", id)
+	if err != nil {
+		return err
+	}
+	if r == nil || r.(*Group).Completed == 0 {
+		return nil
+	}
+	group := *r.(*Group) // copy required for update
+	group.Completed = 0
+	return txn.Insert("groups", &group)
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"log"
+	"time"
+
+	"github.com/hashicorp/go-memdb"
+)
+
+// History keeps the state transitions of a task. It outlives the task, so
+// that deletions can be inspected too, until pruned by PruneHistory.
+type History struct {
+	Id      string         `json:"id"`
+	Events  []HistoryEvent `json:"events"`
+	Deleted uint64         `json:"deleted,omitempty"`
+}
+
+type HistoryEvent struct {
+	Time   uint64 `json:"time"`
+	Action string `json:"action"` // insert, acquire, update, cancel, release, requeue, edit, priority, pool, import, delete
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Worker string `json:"worker,omitempty"`
+	Status string `json:"status,omitempty"`
+	Actor  string `json:"actor,omitempty"` // name of the API token
+}
+
+// recordTransition appends the transition of task from the old state to its
+// history and emits the task event.
+func (db *DB) recordTransition(txn *memdb.Txn, action string, from int, task *Task) error {
+	db.emitEvent(txn, eventType(action, task), task)
+	size := db.cfg.HistorySize
+	if size <= 0 {
+		return nil
+	}
+	history := &History{Id: task.Id}
+	r, err := txn.First("history", "id", task.Id)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		*history = *r.(*History) // copy required for update
+	}
+	events := history.Events
+	if len(events) >= size {
+		events = events[len(events)-size+1:]
+	}
+	history.Events = make([]HistoryEvent, 0, len(events)+1)
+	history.Events = append(history.Events, events...)
+	history.Events = append(history.Events, HistoryEvent{
+		Time:   uint64(time.Now().Unix()),
+		Action: action,
+		From:   from,
+		To:     task.State,
+		Worker: task.Worker,
+		Status: task.Status,
+		Actor:  db.actor,
+	})
+	history.Deleted = 0
+	if action == "delete" {
+		history.Deleted = history.Events[len(history.Events)-1].Time
+	}
+	return txn.Insert("history", history)
+}
+
+func (db *DB) GetHistory(id string) (*History, error) {
+	txn := db.memdb.Txn(false)
+	r, err := txn.First("history", "id", id)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		return r.(*History), nil
+	}
+	return nil, nil
+}
+
+// PruneHistory drops histories of tasks deleted before the given time.
+func (db *DB) PruneHistory(before uint64) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	it, err := txn.Get("history", "id")
+	if err != nil {
+		return err
+	}
+	pruned := []*History{}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		h := obj.(*History)
+		if h.Deleted != 0 && h.Deleted < before {
+			pruned = append(pruned, h)
+		}
+	}
+	for _, h := range pruned {
+		if err := txn.Delete("history", h); err != nil {
+			return err
+		}
+	}
+	if err := db.commit(txn); err != nil {
+		return err
+	}
+	if len(pruned) > 0 {
+		log.Printf("history pruned: %d deleted tasks", len(pruned))
+	}
+	return nil
+}
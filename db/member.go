@@ -0,0 +1,74 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// Member is a node of the cluster. Addr is the http url of the node, so
+// that followers can forward writes to the leader.
+type Member struct {
+	Id       string `json:"id"`
+	RaftAddr string `json:"raft_addr"`
+	Addr     string `json:"addr"`
+	Updated  uint64 `json:"updated"`
+}
+
+func (db *DB) SetMember(m *Member) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	member := *m
+	member.Updated = uint64(time.Now().Unix())
+	if err := txn.Insert("members", &member); err != nil {
+		return err
+	}
+	if err := db.commit(txn); err != nil {
+		return err
+	}
+	log.Printf("member %s set: raft: %s, addr: %s", m.Id, m.RaftAddr, m.Addr)
+	return nil
+}
+
+func (db *DB) DeleteMember(id string) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	if _, err := txn.DeleteAll("members", "id", id); err != nil {
+		return err
+	}
+	if err := db.commit(txn); err != nil {
+		return err
+	}
+	log.Printf("member %s deleted", id)
+	return nil
+}
+
+func (db *DB) GetMember(id string) (*Member, error) {
+	txn := db.memdb.Txn(false)
+	r, err := txn.First("members", "id", id)
+	if err != nil {
+		return nil, err
+	}
+	if r != nil {
+		return r.(*Member), nil
+	}
+	return nil, nil
+}
+
+func (db *DB) GetMembers() ([]*Member, error) {
+	txn := db.memdb.Txn(false)
+	it, err := txn.Get("members", "id")
+	if err != nil {
+		return nil, err
+	}
+	members := []*Member{}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		members = append(members, obj.(*Member))
+	}
+	return members, nil
+}
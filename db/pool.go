@@ -0,0 +1,49 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// Pool keeps the runtime state of a pool set via the API.
+type Pool struct {
+	Name    string `json:"name"`
+	Paused  bool   `json:"paused"`
+	Updated uint64 `json:"updated"`
+}
+
+// PausePool stops or resumes acquiring of the pool tasks. Tasks already
+// acquired are not affected.
+func (db *DB) PausePool(name string, paused bool) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	pool := &Pool{
+		Name:    name,
+		Paused:  paused,
+		Updated: uint64(time.Now().Unix()),
+	}
+	if err := txn.Insert("pools", pool); err != nil {
+		return err
+	}
+	if err := db.commit(txn); err != nil {
+		return err
+	}
+	log.Printf("pool %s paused: %t", name, paused)
+	return nil
+}
+
+func (db *DB) GetPools() ([]*Pool, error) {
+	txn := db.memdb.Txn(false)
+	it, err := txn.Get("pools", "id")
+	if err != nil {
+		return nil, err
+	}
+	pools := []*Pool{}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		pools = append(pools, obj.(*Pool))
+	}
+	return pools, nil
+}
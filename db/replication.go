@@ -0,0 +1,255 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/boiler/ciri/metrics"
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-memdb"
+)
+
+// Change is a committed mutation of a single record, followers apply them
+// in the order of Seq. Commit marks the last change of a transaction.
+type Change struct {
+	Seq    uint64          `json:"seq"`
+	Delete bool            `json:"delete,omitempty"`
+	Commit bool            `json:"commit,omitempty"`
+	Record *SnapshotRecord `json:"record"`
+}
+
+// ChangeLog keeps the latest changes in a ring buffer for the followers.
+// Id changes with every process start, so that followers notice the
+// sequence restart.
+type ChangeLog struct {
+	Id    string
+	mutex sync.Mutex
+	ring  []*Change
+	next  uint64 // seq of the next change, seqs start from 1
+	subs  map[chan struct{}]struct{}
+}
+
+func NewChangeLog(size int) *ChangeLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &ChangeLog{
+		Id:   uuid.NewString(),
+		ring: make([]*Change, size),
+		next: 1,
+		subs: make(map[chan struct{}]struct{}),
+	}
+}
+
+func (l *ChangeLog) publish(changes []*Change) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, c := range changes {
+		c.Seq = l.next
+		l.ring[c.Seq%uint64(len(l.ring))] = c
+		l.next++
+	}
+	for ch := range l.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Since returns changes after the given seq. ok is false when some of them
+// already left the buffer or the seq is unknown, the follower has to start
+// from a snapshot then.
+func (l *ChangeLog) Since(seq uint64) (changes []*Change, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	size := uint64(len(l.ring))
+	if seq >= l.next || l.next > size && seq+1 < l.next-size {
+		return nil, false
+	}
+	for i := seq + 1; i < l.next; i++ {
+		changes = append(changes, l.ring[i%size])
+	}
+	return changes, true
+}
+
+// LastSeq returns the seq of the latest change.
+func (l *ChangeLog) LastSeq() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.next - 1
+}
+
+// Subscribe returns a channel signalled after new changes are published and
+// a function to cancel the subscription.
+func (l *ChangeLog) Subscribe() (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	l.mutex.Lock()
+	l.subs[ch] = struct{}{}
+	l.mutex.Unlock()
+	return ch, func() {
+		l.mutex.Lock()
+		delete(l.subs, ch)
+		l.mutex.Unlock()
+	}
+}
+
+func (db *DB) Changes() *ChangeLog {
+	return db.changes
+}
+
+func recordOf(obj interface{}) *SnapshotRecord {
+	switch v := obj.(type) {
+	case *Task:
+		return &SnapshotRecord{Task: v}
+	case *Group:
+		return &SnapshotRecord{Group: v}
+	case *History:
+		return &SnapshotRecord{History: v}
+	case *Pool:
+		return &SnapshotRecord{Pool: v}
+	case *Member:
+		return &SnapshotRecord{Member: v}
+	}
+	return nil
+}
+
+// ReplicaSnapshot returns the seq of the latest change and a function that
+// encodes the tables as of that change.
+func (db *DB) ReplicaSnapshot() (uint64, func(io.Writer) (*SnapshotInfo, error)) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.changes.LastSeq(), db.SnapshotEncoder()
+}
+
+// SnapshotEncoder returns a function that encodes the tables as of now. It
+// doesn't wait for the writers.
+func (db *DB) SnapshotEncoder() func(io.Writer) (*SnapshotInfo, error) {
+	txn := db.memdb.Txn(false)
+	return func(w io.Writer) (*SnapshotInfo, error) {
+		return encodeSnapshot(txn, w)
+	}
+}
+
+// LoadReplica replaces the content of all tables with the snapshot read
+// from r.
+func (db *DB) LoadReplica(r io.Reader) (*SnapshotInfo, error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	it, err := txn.Get("tasks", "id")
+	if err != nil {
+		return nil, err
+	}
+	for obj := it.Next(); obj != nil; obj = it.Next() {
+		t := obj.(*Task)
+		db.onCommit(func() {
+			metrics.GaugeDec("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
+		})
+	}
+	for _, table := range tables {
+		if _, err := txn.DeleteAll(table, "id"); err != nil {
+			return nil, err
+		}
+	}
+	info, err := DecodeSnapshot(r, func(rec *SnapshotRecord) error {
+		return db.insertRecord(txn, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	db.commitLocal(txn)
+	log.Printf("replica loaded: %d records", info.Records)
+	return info, nil
+}
+
+// ApplyChanges applies the changes of a leader transaction at once.
+func (db *DB) ApplyChanges(changes []*Change) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	for _, c := range changes {
+		c := c
+		old, err := applyChange(txn, c)
+		if err != nil {
+			return err
+		}
+		db.onCommit(func() {
+			moveTaskGauge(old, c)
+		})
+	}
+	db.commitLocal(txn)
+	return nil
+}
+
+// ApplyCommitted stores the changes committed by the Replicator. It does not
+// take db.mutex, which is held by the writer waiting for the changes; the
+// memdb writer lock serializes it with other transactions. Metrics and events
+// are published by the writer on the node that made the changes, remote is
+// set for the changes of the other nodes.
+func (db *DB) ApplyCommitted(changes []*Change, events []*Event, remote bool) error {
+	txn := db.memdb.Txn(true)
+	defer txn.Abort()
+	for _, c := range changes {
+		c := c
+		old, err := applyChange(txn, c)
+		if err != nil {
+			return err
+		}
+		if remote {
+			txn.Defer(func() {
+				moveTaskGauge(old, c)
+			})
+		}
+	}
+	if remote && len(events) > 0 {
+		txn.Defer(func() {
+			db.events.publish(events)
+		})
+	}
+	txn.Commit()
+	return nil
+}
+
+// applyChange replaces the record of the change, returning the old task if
+// the change is for a task.
+func applyChange(txn *memdb.Txn, c *Change) (*Task, error) {
+	if c.Record == nil {
+		return nil, fmt.Errorf("change %d: empty record", c.Seq)
+	}
+	table, id, obj := recordTable(c.Record)
+	if table == "" {
+		return nil, fmt.Errorf("change %d: empty record", c.Seq)
+	}
+	old, err := txn.First(table, "id", id)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		if err := txn.Delete(table, old); err != nil {
+			return nil, err
+		}
+	}
+	if !c.Delete {
+		if err := txn.Insert(table, obj); err != nil {
+			return nil, err
+		}
+	}
+	t, _ := old.(*Task)
+	return t, nil
+}
+
+func moveTaskGauge(old *Task, c *Change) {
+	if old != nil {
+		metrics.GaugeDec("tasks_count", old.Sticker, old.Priority, old.Pool, old.State)
+	}
+	if t := c.Record.Task; t != nil && !c.Delete {
+		metrics.GaugeInc("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
+	}
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/boiler/ciri/config"
+)
+
+// TestApplyChanges loads a replica snapshot and applies the later changes,
+// as a follower does.
+func TestApplyChanges(t *testing.T) {
+	leader := newTestDB(t, &config.Config{ReplicationLogSize: 100})
+	insertTask(t, leader, "t1")
+	seq, encode := leader.ReplicaSnapshot()
+	buf := &bytes.Buffer{}
+	if _, err := encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	insertTask(t, leader, "t2")
+	task := acquire(t, leader, "w1")
+	if _, err := leader.UpdateTask(task, StateDone, "ok", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	insertTask(t, leader, "t3")
+	t3, _ := leader.GetTask("id", "t3")
+	if err := leader.DeleteTask(t3); err != nil {
+		t.Fatal(err)
+	}
+
+	follower := newTestDB(t, nil)
+	if _, err := follower.LoadReplica(buf); err != nil {
+		t.Fatal(err)
+	}
+	changes, ok := leader.Changes().Since(seq)
+	if !ok || len(changes) == 0 {
+		t.Fatalf("changes since %d: %d, %v", seq, len(changes), ok)
+	}
+	if err := follower.ApplyChanges(changes); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"t1", "t2"} {
+		expected, _ := leader.GetTask("id", id)
+		got, _ := follower.GetTask("id", id)
+		if got == nil || got.State != expected.State || got.Version != expected.Version {
+			t.Errorf("task %s: %+v, expected %+v", id, got, expected)
+		}
+	}
+	if got, _ := follower.GetTask("id", "t3"); got != nil {
+		t.Error("deleted task t3 kept by the follower")
+	}
+}
+
+func TestChangeLogSince(t *testing.T) {
+	l := NewChangeLog(4)
+	for i := 0; i < 6; i++ {
+		l.publish([]*Change{{Record: &SnapshotRecord{}}})
+	}
+	if seq := l.LastSeq(); seq != 6 {
+		t.Fatalf("last seq %d, expected 6", seq)
+	}
+	for _, tc := range []struct {
+		since uint64
+		count int
+		ok    bool
+	}{
+		{6, 0, true},
+		{3, 3, true},
+		{2, 4, true},
+		{1, 0, false}, // change 2 left the ring
+		{7, 0, false}, // seq of another log
+	} {
+		changes, ok := l.Since(tc.since)
+		if ok != tc.ok || len(changes) != tc.count {
+			t.Errorf("since %d: %d changes, %v; expected %d, %v", tc.since, len(changes), ok, tc.count, tc.ok)
+		}
+		for i, c := range changes {
+			if c.Seq != tc.since+uint64(i)+1 {
+				t.Errorf("since %d: change %d has seq %d", tc.since, i, c.Seq)
+			}
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/boiler/ciri/metrics"
+	"github.com/hashicorp/go-memdb"
+)
+
+// snapshotHeader starts a snapshot file. Files without the header are read
+// as a plain stream of tasks written by earlier versions.
+type snapshotHeader struct {
+	Format  string
+	Version int
+}
+
+// SnapshotRecord is a single entry of a snapshot, exactly one field is set.
+// The End record closes the file, so truncated snapshots are detected.
+type SnapshotRecord struct {
+	Task    *Task        `json:"task,omitempty"`
+	Group   *Group       `json:"group,omitempty"`
+	History *History     `json:"history,omitempty"`
+	Pool    *Pool        `json:"pool,omitempty"`
+	Member  *Member      `json:"member,omitempty"`
+	End     *SnapshotEnd `json:"end,omitempty"`
+}
+
+type SnapshotEnd struct {
+	Records int `json:"records"`
+}
+
+// SnapshotInfo describes a decoded snapshot.
+type SnapshotInfo struct {
+	Version int  `json:"version"` // 0 for headerless snapshots of earlier versions
+	Records int  `json:"records"`
+	Tasks   int  `json:"tasks"`
+	Ended   bool `json:"ended"` // End record found
+}
+
+// SnapshotStatus reports the outcome of the latest snapshot writes.
+type SnapshotStatus struct {
+	Path      string  `json:"path,omitempty"`
+	Time      uint64  `json:"time,omitempty"` // last successful write
+	Duration  float64 `json:"duration"`       // seconds
+	Size      int64   `json:"size"`           // bytes
+	Tasks     int     `json:"tasks"`
+	Records   int     `json:"records"`
+	Error     string  `json:"error,omitempty"` // of the last write, if failed
+	ErrorTime uint64  `json:"error_time,omitempty"`
+	Failures  int     `json:"failures"` // since the start
+}
+
+// tables are the tables stored in snapshots, in the order of records.
+var tables = []string{"tasks", "groups", "history", "pools", "members"}
+
+const snapshotFormat = "ciri"
+const snapshotVersion = 3
+
+type SnapshotWriter struct {
+	enc     *gob.Encoder
+	records int
+}
+
+func NewSnapshotWriter(w io.Writer) (*SnapshotWriter, error) {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotHeader{snapshotFormat, snapshotVersion}); err != nil {
+		return nil, err
+	}
+	return &SnapshotWriter{enc: enc}, nil
+}
+
+func (sw *SnapshotWriter) Write(rec *SnapshotRecord) error {
+	sw.records++
+	return sw.enc.Encode(rec)
+}
+
+// Close writes the End record, the underlying writer is not closed.
+func (sw *SnapshotWriter) Close() error {
+	return sw.enc.Encode(&SnapshotRecord{End: &SnapshotEnd{Records: sw.records}})
+}
+
+// recordingReader keeps the bytes read, so that the stream can be replayed
+// after a failed header decode.
+type recordingReader struct {
+	r    io.Reader
+	buf  bytes.Buffer
+	stop bool
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if !rr.stop {
+		rr.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// DecodeSnapshot calls fn for every record of the snapshot read from r.
+func DecodeSnapshot(r io.Reader, fn func(*SnapshotRecord) error) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{}
+	rr := &recordingReader{r: r}
+	dec := gob.NewDecoder(rr)
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil || header.Format != snapshotFormat {
+		if err == io.EOF {
+			return info, nil
+		}
+		// no header, snapshot of an earlier version
+		dec = gob.NewDecoder(io.MultiReader(&rr.buf, r))
+		for {
+			var t Task
+			err := dec.Decode(&t)
+			if err == io.EOF {
+				return info, nil
+			}
+			if err != nil {
+				return info, err
+			}
+			info.Records++
+			info.Tasks++
+			if err := fn(&SnapshotRecord{Task: &t}); err != nil {
+				return info, err
+			}
+		}
+	}
+	rr.stop = true
+	rr.buf = bytes.Buffer{}
+	info.Version = header.Version
+	if header.Version > snapshotVersion {
+		return info, fmt.Errorf("unsupported snapshot version: %d", header.Version)
+	}
+
+	for {
+		var rec SnapshotRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, err
+		}
+		if info.Ended {
+			return info, fmt.Errorf("records after the end of snapshot")
+		}
+		if rec.End != nil {
+			info.Ended = true
+			if rec.End.Records != info.Records {
+				return info, fmt.Errorf("snapshot records mismatch: %d, expected %d", info.Records, rec.End.Records)
+			}
+			continue
+		}
+		info.Records++
+		if rec.Task != nil {
+			info.Tasks++
+		}
+		if err := fn(&rec); err != nil {
+			return info, err
+		}
+	}
+	if header.Version >= 3 && !info.Ended {
+		return info, fmt.Errorf("snapshot truncated after %d records", info.Records)
+	}
+	return info, nil
+}
+
+// EncodeSnapshot writes all tables from a single read transaction.
+func (db *DB) EncodeSnapshot(w io.Writer) (*SnapshotInfo, error) {
+	txn := db.memdb.Txn(false)
+	defer txn.Abort()
+	return encodeSnapshot(txn, w)
+}
+
+func encodeSnapshot(txn *memdb.Txn, w io.Writer) (*SnapshotInfo, error) {
+	sw, err := NewSnapshotWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	info := &SnapshotInfo{Version: snapshotVersion}
+	for _, table := range tables {
+		it, err := txn.Get(table, "id")
+		if err != nil {
+			return nil, err
+		}
+		for obj := it.Next(); obj != nil; obj = it.Next() {
+			rec := recordOf(obj)
+			if rec.Task != nil {
+				info.Tasks++
+			}
+			if err := sw.Write(rec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	info.Records = sw.records
+	info.Ended = true
+	return info, sw.Close()
+}
+
+// WriteSnapshot writes the snapshot to a temporary file renamed to path.
+// The outcome is kept for SnapshotStatus and the metrics only for the
+// configured snapshot_path, so that one-off snapshots don't hide its failures.
+func (db *DB) WriteSnapshot(path string) error {
+	db.snapshotMutex.Lock()
+	defer db.snapshotMutex.Unlock()
+	log.Printf("writing snapshot: %s", path)
+	start := time.Now()
+	info, size, err := db.writeSnapshot(path)
+	if path != db.cfg.SnapshotPath {
+		if err != nil {
+			log.Printf("writing snapshot failed: %s", err)
+			return err
+		}
+		log.Printf("writing snapshot done: %d tasks, %d bytes", info.Tasks, size)
+		return nil
+	}
+
+	db.statusMutex.Lock()
+	defer db.statusMutex.Unlock()
+	status := &db.snapshotStatus
+	if err != nil {
+		status.Error = err.Error()
+		status.ErrorTime = uint64(time.Now().Unix())
+		status.Failures++
+		metrics.CountAdd("snapshot_errors", 1)
+		log.Printf("writing snapshot failed: %s", err)
+		return err
+	}
+	status.Path = path
+	status.Time = uint64(time.Now().Unix())
+	status.Duration = time.Since(start).Seconds()
+	status.Size = size
+	status.Tasks = info.Tasks
+	status.Records = info.Records
+	status.Error = ""
+	status.ErrorTime = 0
+	metrics.GaugeSet("snapshot_last_success", float64(status.Time))
+	metrics.GaugeSet("snapshot_duration_seconds", status.Duration)
+	metrics.GaugeSet("snapshot_size_bytes", float64(size))
+	metrics.GaugeSet("snapshot_tasks", float64(info.Tasks))
+	log.Printf("writing snapshot done: %d tasks, %d bytes", info.Tasks, size)
+	return nil
+}
+
+func (db *DB) writeSnapshot(path string) (*SnapshotInfo, int64, error) {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, 0, err
+	}
+	w := bufio.NewWriter(f)
+	ew, err := db.keys.Writer(w)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	info, err := db.EncodeSnapshot(ew)
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, 0, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, 0, err
+	}
+	return info, fi.Size(), nil
+}
+
+func (db *DB) SnapshotStatus() SnapshotStatus {
+	db.statusMutex.Lock()
+	defer db.statusMutex.Unlock()
+	return db.snapshotStatus
+}
+
+func (db *DB) ReadSnapshot(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	log.Printf("reading snapshot: %s", path)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := db.keys.Reader(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("snapshot %s: %s", path, err)
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	txn := db.writeTxn()
+	defer txn.Abort()
+
+	_, err = DecodeSnapshot(r, func(rec *SnapshotRecord) error {
+		return db.insertRecord(txn, rec)
+	})
+	if err != nil {
+		return err
+	}
+	db.commitLocal(txn)
+	log.Printf("reading snapshot done")
+	return nil
+}
+
+// insertRecord stores the snapshot record as is.
+func (db *DB) insertRecord(txn *memdb.Txn, rec *SnapshotRecord) error {
+	table, _, obj := recordTable(rec)
+	if table == "" {
+		return nil
+	}
+	if err := txn.Insert(table, obj); err != nil {
+		return err
+	}
+	if t := rec.Task; t != nil {
+		db.onCommit(func() {
+			metrics.GaugeInc("tasks_count", t.Sticker, t.Priority, t.Pool, t.State)
+		})
+	}
+	return nil
+}
+
+// recordTable returns the table, the id and the object of the record, an
+// empty table for the End or empty records.
+func recordTable(rec *SnapshotRecord) (string, string, interface{}) {
+	switch {
+	case rec.Task != nil:
+		return "tasks", rec.Task.Id, rec.Task
+	case rec.Group != nil:
+		return "groups", rec.Group.Id, rec.Group
+	case rec.History != nil:
+		return "history", rec.History.Id, rec.History
+	case rec.Pool != nil:
+		return "pools", rec.Pool.Name, rec.Pool
+	case rec.Member != nil:
+		return "members", rec.Member.Id, rec.Member
+	}
+	return "", "", nil
+}
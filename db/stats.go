@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+type StatsRow struct {
+	Pool     string `json:"pool,omitempty"`
+	Sticker  string `json:"sticker,omitempty"`
+	State    *int   `json:"state,omitempty"`
+	Priority *int   `json:"priority,omitempty"`
+	Count    int    `json:"count"`
+}
+
+type PoolStats struct {
+	OldestNewAge uint64  `json:"oldest_new_age"` // seconds
+	AvgWait      float64 `json:"avg_wait"`       // seconds from insert to acquire
+	AvgRun       float64 `json:"avg_run"`        // seconds from acquire to finish
+	waitSum      uint64
+	waitCount    int
+	runSum       uint64
+	runCount     int
+}
+
+type Stats struct {
+	Rows  []*StatsRow           `json:"rows"`
+	Pools map[string]*PoolStats `json:"pools"`
+}
+
+// GetStats counts the tasks matching the filter grouped by any of pool,
+// sticker, state and priority. It runs on a read transaction, so writers are
+// not blocked.
+func (db *DB) GetStats(f *Filter, groupBy []string) (*Stats, error) {
+	group := make(map[string]bool)
+	for _, g := range groupBy {
+		switch g {
+		case "pool", "sticker", "state", "priority":
+			group[g] = true
+		default:
+			return nil, fmt.Errorf("bad group_by: %s", g)
+		}
+	}
+
+	type rowKey struct {
+		pool     string
+		sticker  string
+		state    int
+		priority int
+	}
+	rows := make(map[rowKey]*StatsRow)
+	pools := make(map[string]*PoolStats)
+	now := uint64(time.Now().Unix())
+
+	txn := db.memdb.Txn(false)
+	err := f.Each(txn, func(t *Task) error {
+		key := rowKey{}
+		row := &StatsRow{}
+		if group["pool"] {
+			key.pool, row.Pool = t.Pool, t.Pool
+		}
+		if group["sticker"] {
+			key.sticker, row.Sticker = t.Sticker, t.Sticker
+		}
+		if group["state"] {
+			state := t.State
+			key.state, row.State = state, &state
+		}
+		if group["priority"] {
+			priority := t.Priority
+			key.priority, row.Priority = priority, &priority
+		}
+		if r, ok := rows[key]; ok {
+			row = r
+		} else {
+			rows[key] = row
+		}
+		row.Count++
+
+		ps, ok := pools[t.Pool]
+		if !ok {
+			ps = &PoolStats{}
+			pools[t.Pool] = ps
+		}
+		if t.State == StateNew && now > t.Added && now-t.Added > ps.OldestNewAge {
+			ps.OldestNewAge = now - t.Added
+		}
+		if t.Started >= t.Added && t.Started != 0 {
+			ps.waitSum += t.Started - t.Added
+			ps.waitCount++
+		}
+		if t.Finished() && t.Completed >= t.Started && t.Started != 0 {
+			ps.runSum += t.Completed - t.Started
+			ps.runCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		Rows:  []*StatsRow{},
+		Pools: pools,
+	}
+	for _, row := range rows {
+		stats.Rows = append(stats.Rows, row)
+	}
+	intVal := func(p *int) int {
+		if p == nil {
+			return 0
+		}
+		return *p
+	}
+	sort.Slice(stats.Rows, func(i, j int) bool {
+		a, b := stats.Rows[i], stats.Rows[j]
+		switch {
+		case a.Pool != b.Pool:
+			return a.Pool < b.Pool
+		case a.Sticker != b.Sticker:
+			return a.Sticker < b.Sticker
+		case intVal(a.State) != intVal(b.State):
+			return intVal(a.State) < intVal(b.State)
+		}
+		return intVal(a.Priority) < intVal(b.Priority)
+	})
+	for _, ps := range pools {
+		if ps.waitCount > 0 {
+			ps.AvgWait = float64(ps.waitSum) / float64(ps.waitCount)
+		}
+		if ps.runCount > 0 {
+			ps.AvgRun = float64(ps.runSum) / float64(ps.runCount)
+		}
+	}
+	return stats, nil
+}
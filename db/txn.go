@@ -0,0 +1,96 @@
+package db
+
+import (
+	"github.com/hashicorp/go-memdb"
+)
+
+// Replicator passes the changes and the events of write transactions through
+// a replicated log. Apply returns after ApplyCommitted has stored the changes
+// on this node.
+type Replicator interface {
+	Apply(changes []*Change, events []*Event) error
+}
+
+// SetReplicator makes the write transactions commit through r, nil commits
+// them locally.
+func (db *DB) SetReplicator(r Replicator) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.replicator = r
+}
+
+// writeTxn starts a write transaction, db.mutex must be held. It is finished
+// by commit, or commitLocal for changes that are already replicated.
+func (db *DB) writeTxn() *memdb.Txn {
+	txn := db.memdb.Txn(true)
+	txn.TrackChanges()
+	db.pendingEvents = nil
+	db.pendingFns = nil
+	return txn
+}
+
+// onCommit queues fn until the transaction commits, like txn.Defer; the
+// functions run in reverse order.
+func (db *DB) onCommit(fn func()) {
+	db.pendingFns = append(db.pendingFns, fn)
+}
+
+// commit stores the transaction, through the replicator if set. The
+// transaction is aborted then and the replicator applies its changes.
+func (db *DB) commit(txn *memdb.Txn) error {
+	if db.replicator == nil {
+		db.commitLocal(txn)
+		return nil
+	}
+	changes := changesOf(txn)
+	txn.Abort()
+	if len(changes) > 0 {
+		if err := db.replicator.Apply(changes, db.pendingEvents); err != nil {
+			db.pendingEvents = nil
+			db.pendingFns = nil
+			return &Error{Kind: KindUnavailable, Msg: err.Error()}
+		}
+	}
+	db.afterCommit(changes)
+	return nil
+}
+
+func (db *DB) commitLocal(txn *memdb.Txn) {
+	txn.Commit()
+	db.afterCommit(changesOf(txn))
+}
+
+func (db *DB) afterCommit(changes []*Change) {
+	for i := len(db.pendingFns) - 1; i >= 0; i-- {
+		db.pendingFns[i]()
+	}
+	db.pendingFns = nil
+	if len(changes) > 0 {
+		db.changes.publish(changes)
+	}
+	if len(db.pendingEvents) > 0 {
+		db.events.publish(db.pendingEvents)
+	}
+	db.pendingEvents = nil
+}
+
+// changesOf returns the changes of the transaction, the last one marked
+// with Commit.
+func changesOf(txn *memdb.Txn) []*Change {
+	var changes []*Change
+	for _, c := range txn.Changes() {
+		obj := c.After
+		if c.Deleted() {
+			obj = c.Before
+		}
+		rec := recordOf(obj)
+		if rec == nil {
+			continue
+		}
+		changes = append(changes, &Change{Delete: c.Deleted(), Record: rec})
+	}
+	if len(changes) > 0 {
+		changes[len(changes)-1].Commit = true
+	}
+	return changes
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/boiler/ciri/cluster"
+	"github.com/boiler/ciri/db"
+	"github.com/boiler/ciri/webhook"
+)
+
+func (h *Handler) clusterStatus(w http.ResponseWriter, r *http.Request, req *request) {
+	if h.cluster == nil {
+		h.retErr(w, "cluster not configured")
+		return
+	}
+	status, err := h.cluster.Status()
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	type OkData struct {
+		Result string          `json:"result"`
+		Status *cluster.Status `json:"status"`
+	}
+	json, _ := json.Marshal(OkData{"ok", status})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) replicationStatus(w http.ResponseWriter, r *http.Request, req *request) {
+	type OkData struct {
+		Result string             `json:"result"`
+		Status *ReplicationStatus `json:"status"`
+	}
+	json, _ := json.Marshal(OkData{"ok", h.ReplicationStatus()})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) webhookDeliveries(w http.ResponseWriter, r *http.Request, req *request) {
+	type OkData struct {
+		Result     string             `json:"result"`
+		Deliveries []webhook.Delivery `json:"deliveries"`
+	}
+	json, _ := json.Marshal(OkData{"ok", h.webhooks.Deliveries()})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) adminExport(w http.ResponseWriter, r *http.Request, req *request) {
+	filter, err := db.ParseFilter(r.URL.Query())
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	w.Header().Set("content-type", "application/x-ndjson")
+	err = req.db.ExportTasks(filter, func(t *db.Task) error {
+		if !req.tok.allows(t) {
+			return nil
+		}
+		json, _ := json.Marshal(t)
+		w.Write(json)
+		_, err := w.Write([]byte("\n"))
+		return err
+	})
+	if err != nil {
+		log.Printf("export failed: %s", err)
+	}
+}
+
+func (h *Handler) adminSnapshotStatus(w http.ResponseWriter, r *http.Request, req *request) {
+	type OkData struct {
+		Result string             `json:"result"`
+		Status *db.SnapshotStatus `json:"status"`
+	}
+	status := req.db.SnapshotStatus()
+	json, _ := json.Marshal(OkData{"ok", &status})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) adminSnapshot(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Path string `json:"path"`
+	}
+	postData := &PostData{Path: h.cfg.SnapshotPath}
+	if len(bytes.TrimSpace(req.body)) > 0 {
+		err := json.Unmarshal(req.body, postData)
+		if err != nil {
+			h.retErr(w, err.Error())
+			return
+		}
+	}
+	if h.cfg.SnapshotPath == "" {
+		h.retErr(w, "snapshot_path not configured")
+		return
+	}
+	// other paths are limited to the directory of snapshot_path
+	dir := filepath.Dir(filepath.Clean(h.cfg.SnapshotPath))
+	path := filepath.Clean(postData.Path)
+	if !filepath.IsAbs(path) && filepath.Base(path) == path {
+		path = filepath.Join(dir, path)
+	}
+	if filepath.Dir(path) != dir || postData.Path == "" {
+		h.retForbidden(w, "snapshot path must be in the directory "+dir)
+		return
+	}
+	if path == filepath.Clean(h.cfg.SnapshotPath) {
+		path = h.cfg.SnapshotPath
+	}
+	if err := req.db.WriteSnapshot(path); err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	type OkData struct {
+		Result string             `json:"result"`
+		Path   string             `json:"path"`
+		Status *db.SnapshotStatus `json:"status,omitempty"` // of snapshot_path
+	}
+	okData := OkData{Result: "ok", Path: path}
+	if path == h.cfg.SnapshotPath {
+		status := req.db.SnapshotStatus()
+		okData.Status = &status
+	}
+	json, _ := json.Marshal(okData)
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) clusterMember(w http.ResponseWriter, r *http.Request, req *request) {
+	if h.cluster == nil {
+		h.retErr(w, "cluster not configured")
+		return
+	}
+	member := &db.Member{}
+	err := json.Unmarshal(req.body, member)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if r.URL.Path == "/v1/cluster/join" {
+		err = h.cluster.Join(member)
+	} else {
+		err = h.cluster.Remove(member.Id)
+	}
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	w.Write([]byte(`{"result":"ok"}` + "\n"))
+}
+
+func (h *Handler) adminPromote(w http.ResponseWriter, r *http.Request, req *request) {
+	if err := h.Promote(); err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	w.Write([]byte(`{"result":"ok"}` + "\n"))
+}
+
+func (h *Handler) adminImport(w http.ResponseWriter, r *http.Request, req *request) {
+	tasks := []*db.Task{}
+	for i, line := range bytes.Split(req.body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		task := &db.Task{}
+		if err := json.Unmarshal(line, task); err != nil {
+			h.retErr(w, fmt.Sprintf("line %d: can't parse json: %s", i+1, err))
+			return
+		}
+		if !req.tok.allows(task) {
+			h.retForbidden(w, fmt.Sprintf("line %d: task out of token scope", i+1))
+			return
+		}
+		tasks = append(tasks, task)
+	}
+	res, err := req.db.ImportTasks(tasks, r.URL.Query().Get("conflict"), req.tok.allows)
+	if err != nil {
+		// a conflict of conflict=fail is told apart by its 409, unlike the
+		// older v1 routes
+		code := errCode(err)
+		h.writeErr(w, codeStatus[code], code, err.Error())
+		return
+	}
+	type OkData struct {
+		Result string `json:"result"`
+		*db.ImportResult
+	}
+	json, _ := json.Marshal(OkData{"ok", res})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
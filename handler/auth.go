@@ -0,0 +1,178 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"github.com/boiler/ciri/certs"
+	"github.com/boiler/ciri/config"
+	"github.com/boiler/ciri/db"
+)
+
+// Token roles, admin is allowed everything.
+const (
+	RoleProducer = "producer"
+	RoleWorker   = "worker"
+	RoleAdmin    = "admin"
+)
+
+// token is a configured API token, only its hash is kept.
+type token struct {
+	name       string
+	hash       []byte // nil for client certificate only tokens
+	clientCert string
+	worker     string
+	rate       float64 // rate limit of the token, the global one if 0
+	burst      int
+	roles      map[string]bool
+	pools      map[string]bool
+	stickers   map[string]bool
+}
+
+// anonymous is used for all requests when no tokens are configured.
+var anonymous = &token{roles: map[string]bool{RoleAdmin: true}}
+
+// newTokens returns the [[token]] entries and the legacy auth_token, which is
+// an admin token named auth_token.
+func newTokens(cfg *config.Config) ([]*token, error) {
+	set := func(l []string) map[string]bool {
+		m := make(map[string]bool)
+		for _, v := range l {
+			m[v] = true
+		}
+		return m
+	}
+	tokens := []*token{}
+	if cfg.AuthToken != "" {
+		tokens = append(tokens, &token{
+			name:  "auth_token",
+			hash:  hash(cfg.AuthToken),
+			roles: set([]string{RoleAdmin}),
+		})
+	}
+	names := make(map[string]bool)
+	for _, ct := range cfg.Token {
+		if ct.Name == "" || ct.Token == "" && ct.ClientCert == "" {
+			return nil, fmt.Errorf("token: name and token or client_cert required")
+		}
+		if names[ct.Name] {
+			return nil, fmt.Errorf("token %s: duplicate name", ct.Name)
+		}
+		names[ct.Name] = true
+		for _, role := range ct.Roles {
+			if role != RoleProducer && role != RoleWorker && role != RoleAdmin {
+				return nil, fmt.Errorf("token %s: unknown role: %s", ct.Name, role)
+			}
+		}
+		t := &token{
+			name:       ct.Name,
+			clientCert: ct.ClientCert,
+			worker:     ct.Worker,
+			rate:       ct.RateLimit,
+			burst:      ct.RateBurst,
+			roles:      set(ct.Roles),
+			pools:      set(ct.Pools),
+			stickers:   set(ct.Stickers),
+		}
+		if ct.Token != "" {
+			t.hash = hash(ct.Token)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+func hash(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+// authenticate returns the token of the request, nil if it is unknown. All
+// tokens are compared, so that the time doesn't depend on the match. Without
+// the x-auth-token header the verified client certificate is looked up.
+func (h *Handler) authenticate(r *http.Request) *token {
+	if len(h.tokens) == 0 {
+		return anonymous
+	}
+	var found *token
+	if v := r.Header.Get("x-auth-token"); v != "" {
+		sum := hash(v)
+		for _, t := range h.tokens {
+			if t.hash != nil && subtle.ConstantTimeCompare(sum, t.hash) == 1 {
+				found = t
+			}
+		}
+	} else if name := certs.ClientName(r.TLS); name != "" {
+		for _, t := range h.tokens {
+			if t.clientCert == name {
+				found = t
+			}
+		}
+	}
+	return found
+}
+
+// workerName returns the worker name to use for the request, false if the
+// token is bound to another worker.
+func (t *token) workerName(worker string) (string, bool) {
+	if t.worker == "" {
+		return worker, true
+	}
+	if worker == "" {
+		return t.worker, true
+	}
+	return worker, worker == t.worker
+}
+
+func (t *token) hasRole(role string) bool {
+	return t.roles[RoleAdmin] || t.roles[role]
+}
+
+// scoped reports whether the token is limited to some pools or stickers.
+func (t *token) scoped() bool {
+	return len(t.pools) > 0 || len(t.stickers) > 0
+}
+
+// allows reports whether the task is in the scope of the token. Empty pool
+// and sticker are stored as "default".
+func (t *token) allows(task *db.Task) bool {
+	return t.allowsPool(task.Pool) && t.allowsSticker(task.Sticker)
+}
+
+func (t *token) allowsPool(pool string) bool {
+	if pool == "" {
+		pool = "default"
+	}
+	return len(t.pools) == 0 || t.pools[pool]
+}
+
+func (t *token) allowsSticker(sticker string) bool {
+	if sticker == "" {
+		sticker = "default"
+	}
+	return len(t.stickers) == 0 || t.stickers[sticker]
+}
+
+func (h *Handler) retForbidden(w http.ResponseWriter, msg string) {
+	h.retErrCode(w, CodeForbidden, msg)
+}
+
+// checkScope returns true if the task with the id is in the scope of the
+// token, otherwise it writes the error. Missing tasks are left to the route.
+func (h *Handler) checkScope(w http.ResponseWriter, req *request, id string) bool {
+	if !req.tok.scoped() {
+		return true
+	}
+	task, err := req.db.GetTask("id", id)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return false
+	}
+	if task != nil && !req.tok.allows(task) {
+		h.retForbidden(w, "task out of token scope")
+		return false
+	}
+	return true
+}
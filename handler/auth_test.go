@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boiler/ciri/config"
+)
+
+func TestAuthenticateClientCert(t *testing.T) {
+	tokens, err := newTokens(&config.Config{Token: []*config.ConfigToken{
+		{Name: "producer", Token: "secret", Roles: []string{RoleProducer}},
+		{Name: "worker", ClientCert: "worker-1", Roles: []string{RoleWorker}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{tokens: tokens}
+
+	cert := func(name string) []*x509.Certificate {
+		return []*x509.Certificate{{Subject: pkix.Name{CommonName: name}}}
+	}
+	verified := func(name string) *tls.ConnectionState {
+		return &tls.ConnectionState{PeerCertificates: cert(name), VerifiedChains: [][]*x509.Certificate{cert(name)}}
+	}
+	for _, tc := range []struct {
+		name     string
+		header   string
+		tls      *tls.ConnectionState
+		expected string
+	}{
+		{"verified certificate", "", verified("worker-1"), "worker"},
+		{"unknown common name", "", verified("worker-2"), ""},
+		{"unverified certificate", "", &tls.ConnectionState{PeerCertificates: cert("worker-1")}, ""},
+		{"no certificate", "", &tls.ConnectionState{}, ""},
+		{"plain http", "", nil, ""},
+		{"token header first", "secret", verified("worker-1"), "producer"},
+		{"wrong token header", "wrong", verified("worker-1"), ""},
+	} {
+		r := httptest.NewRequest("GET", "/v2/tasks", nil)
+		r.TLS = tc.tls
+		if tc.header != "" {
+			r.Header.Set("x-auth-token", tc.header)
+		}
+		name := ""
+		if tok := h.authenticate(r); tok != nil {
+			name = tok.name
+		}
+		if name != tc.expected {
+			t.Errorf("%s: token %q, expected %q", tc.name, name, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// forwardToLeader proxies the write request to the cluster leader. A
+// request forwarded once is not forwarded again, so that members with
+// different views of the leader don't loop. Requests authenticated by a
+// client certificate are redirected instead.
+func (h *Handler) forwardToLeader(w http.ResponseWriter, r *http.Request) {
+	leader := h.cluster.LeaderAddr()
+	if leader == "" || r.Header.Get("x-ciri-forwarded") != "" {
+		h.retErrCode(w, CodeUnavailable, "no cluster leader")
+		return
+	}
+	if len(h.tokens) > 0 && r.Header.Get("x-auth-token") == "" {
+		// the proxy would present the certificate of this node, so clients
+		// authenticated by their own certificate go to the leader themselves
+		w.Header().Set("location", leader+r.URL.RequestURI())
+		h.retErrCode(w, CodeReadOnly, "client certificate requests go to the leader: "+leader)
+		return
+	}
+	target, err := url.Parse(leader)
+	if err != nil {
+		h.retErrCode(w, CodeUnavailable, "bad leader addr: "+leader)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = h.client.Transport
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		h.retErrCode(w, CodeBadGateway, "leader: "+err.Error())
+	}
+	r.Header.Set("x-ciri-forwarded", h.cfg.Cluster.NodeId)
+	w.Header().Del("content-type")
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,166 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/boiler/ciri/config"
+)
+
+type testNode struct {
+	id      string
+	h       *Handler
+	srv     *httptest.Server
+	stopped bool
+}
+
+func (n *testNode) stop() {
+	if !n.stopped {
+		n.stopped = true
+		n.h.Terminate()
+		n.srv.Close()
+	}
+}
+
+// freeAddr returns a loopback address with a port free for now.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// startNode runs a cluster node, advertising loopback addresses; it
+// bootstraps the cluster without join.
+func startNode(t *testing.T, id string, join string) *testNode {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &httptest.Server{Listener: ln, Config: &http.Server{}}
+	raftAddr := freeAddr(t)
+	_, port, _ := net.SplitHostPort(raftAddr)
+	cfg := newTestConfig()
+	cfg.Cluster = &config.ConfigCluster{
+		NodeId:        id,
+		Bind:          "0.0.0.0:" + port,
+		RaftAdvertise: raftAddr,
+		Advertise:     "http://" + ln.Addr().String(),
+		DataDir:       t.TempDir(),
+		Bootstrap:     join == "",
+		Join:          join,
+	}
+	n := &testNode{id: id, h: New(cfg), srv: srv}
+	n.h.Init()
+	srv.Config.Handler = n.h
+	srv.Start()
+	t.Cleanup(n.stop)
+	return n
+}
+
+// waitFor polls cond until it holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(20 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// hasTask reports whether the task is in the db of every node.
+func hasTask(nodes []*testNode, id string) bool {
+	for _, n := range nodes {
+		if task, _ := n.h.db.GetTask("id", id); task == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// hasInsertEvent reports whether the node published the insert event of the
+// task after the event id.
+func hasInsertEvent(n *testNode, after uint64, id string) bool {
+	events, _ := n.h.db.Events().Since(after)
+	for _, e := range events {
+		if e.Type == "insert" && e.Task != nil && e.Task.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for raft elections")
+	}
+	n0 := startNode(t, "n0", "")
+	waitFor(t, "bootstrap leader", n0.h.cluster.IsLeader)
+	n1 := startNode(t, "n1", n0.srv.URL)
+	n2 := startNode(t, "n2", n0.srv.URL)
+	nodes := []*testNode{n0, n1, n2}
+	waitFor(t, "members", func() bool {
+		status, err := n0.h.cluster.Status()
+		return err == nil && len(status.Servers) == 3 && n1.h.cluster.LeaderAddr() == n0.srv.URL && n2.h.cluster.LeaderAddr() == n0.srv.URL
+	})
+
+	// a write on a follower is forwarded, and every node publishes its event
+	lastEvent := map[*testNode]uint64{}
+	for _, n := range nodes {
+		lastEvent[n] = n.h.db.Events().LastId()
+	}
+	if status, _, body := call(t, n1.srv, http.MethodPost, "/v2/tasks", `{"id":"t1"}`); status != http.StatusCreated {
+		t.Fatalf("insert on a follower: %d %s", status, body)
+	}
+	if task, _ := n0.h.db.GetTask("id", "t1"); task == nil {
+		t.Error("task not applied by the leader before the response")
+	}
+	waitFor(t, "t1 on all nodes", func() bool { return hasTask(nodes, "t1") })
+	for _, n := range nodes {
+		waitFor(t, "insert event on "+n.id, func() bool { return hasInsertEvent(n, lastEvent[n], "t1") })
+	}
+
+	// the others elect a new leader once the leader is gone
+	n0.stop()
+	nodes = []*testNode{n1, n2}
+	var leader, follower *testNode
+	waitFor(t, "new leader", func() bool {
+		for i, n := range nodes {
+			if n.h.cluster.IsLeader() {
+				leader, follower = n, nodes[1-i]
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "insert on the new follower", func() bool {
+		// a conflict means an earlier attempt got through
+		status, _, _ := call(t, follower.srv, http.MethodPost, "/v2/tasks", `{"id":"t2"}`)
+		return status == http.StatusCreated || status == http.StatusConflict
+	})
+	waitFor(t, "t2 on the remaining nodes", func() bool { return hasTask(nodes, "t2") })
+
+	if status, _, body := call(t, leader.srv, http.MethodPost, "/v1/cluster/remove", `{"id":"n0"}`); status != http.StatusOK {
+		t.Fatalf("remove the old leader: %d %s", status, body)
+	}
+	status, err := leader.h.cluster.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Servers) != 2 {
+		t.Errorf("%d servers after the removal, expected 2", len(status.Servers))
+	}
+	if status, _, body := call(t, follower.srv, http.MethodPost, "/v2/tasks", `{"id":"t3"}`); status != http.StatusCreated {
+		t.Fatalf("insert after the removal: %d %s", status, body)
+	}
+	waitFor(t, "t3 on the remaining nodes", func() bool { return hasTask(nodes, "t3") })
+}
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events streams task events as Server-Sent Events. Clients resume with the
+// Last-Event-ID header (or last_event_id parameter); without it the stream
+// starts from new events. Events of tasks out of the token scope are skipped.
+func (h *Handler) Events(w http.ResponseWriter, r *http.Request, tok *token) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.retErr(w, "streaming not supported")
+		return
+	}
+	q := r.URL.Query()
+	pool := q.Get("pool")
+	sticker := q.Get("sticker")
+	id := q.Get("id")
+	types := make(map[string]bool)
+	if v := q.Get("type"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			types[t] = true
+		}
+	}
+
+	eventLog := h.db.Events()
+	last := eventLog.LastId()
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = q.Get("last_event_id")
+	}
+	if lastId != "" {
+		var err error
+		last, err = strconv.ParseUint(lastId, 10, 64)
+		if err != nil {
+			h.retErr(w, "bad last event id: "+lastId)
+			return
+		}
+	}
+
+	ch, cancel := eventLog.Subscribe()
+	defer cancel()
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		events, overflow := eventLog.Since(last)
+		if overflow {
+			// the client missed events, it has to resync with the GET endpoints
+			fmt.Fprint(w, "event: overflow\ndata: {}\n\n")
+			if len(events) == 0 {
+				last = 0 // the id is from before a restart, no events since
+			}
+		}
+		for _, e := range events {
+			last = e.Id
+			if e.Task == nil {
+				continue // group events go to their webhook only
+			}
+			if len(types) > 0 && !types[e.Type] {
+				continue
+			}
+			if !tok.allows(e.Task) {
+				continue
+			}
+			if (pool != "" && e.Task.Pool != pool) || (sticker != "" && e.Task.Sticker != sticker) || (id != "" && e.Task.Id != id) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+		}
+		flusher.Flush()
+
+		select {
+		case <-ch:
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
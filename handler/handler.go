@@ -1,16 +1,19 @@
 package handler
 
 import (
-	"encoding/json"
-	"io"
+	"crypto/tls"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"log"
 
+	"github.com/boiler/ciri/certs"
+	"github.com/boiler/ciri/cluster"
 	"github.com/boiler/ciri/config"
 	"github.com/boiler/ciri/db"
+	"github.com/boiler/ciri/webhook"
 )
 
 type Handler struct {
@@ -18,7 +21,21 @@ type Handler struct {
 	db       *db.DB
 	wg       sync.WaitGroup
 	sigc     chan os.Signal
+	done     chan struct{}
 	safeMode bool
+	webhooks *webhook.Dispatcher
+
+	followerMutex sync.Mutex
+	follower      *follower // set while replicating a leader
+
+	cluster *cluster.Cluster // set in the clustered mode
+	tokens  []*token         // no auth if empty
+
+	certs  *certs.Certs // set with tls configured
+	client *http.Client // for the other nodes
+
+	limiter *limiter
+	routes  []*route
 }
 
 func New(cfg *config.Config) *Handler {
@@ -26,243 +43,97 @@ func New(cfg *config.Config) *Handler {
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &Handler{
+	tokens, err := newTokens(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tlsCerts *certs.Certs
+	client := http.DefaultClient
+	if cfg.TLS != nil {
+		tlsCerts, err = certs.New(cfg.TLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client = tlsCerts.Client()
+	}
+	h := &Handler{
+		tokens:   tokens,
+		limiter:  newLimiter(),
+		certs:    tlsCerts,
+		client:   client,
 		cfg:      cfg,
 		db:       mdb,
 		sigc:     make(chan os.Signal, 1),
+		done:     make(chan struct{}),
 		safeMode: true,
+		webhooks: webhook.New(cfg, mdb.Events()),
 	}
+	h.routes = h.newRoutes()
+	return h
 }
 
 func (h *Handler) Init() {
-	if h.cfg.SnapshotPath != "" {
+	if h.cfg.Cluster != nil {
+		if h.cfg.Follow != "" {
+			log.Fatal("follow can't be used in the clustered mode")
+		}
+		// the state is restored from the raft snapshot and log
+		var err error
+		h.cluster, err = cluster.New(h.cfg, h.db, h.client)
+		if err != nil {
+			log.Fatal(err)
+		}
+		h.webhooks.SetActive(h.cluster.IsLeader)
+	} else if h.cfg.SnapshotPath != "" {
 		err := h.db.ReadSnapshot(h.cfg.SnapshotPath)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
-	h.safeMode = false
-}
-
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.wg.Add(1)
-	defer h.wg.Done()
-	w.Header().Set("content-type", "application/json")
-
-	if r.Method == http.MethodGet && r.URL.Path == "/health" {
-		h.Health(w, r)
-		return
+	if h.cfg.Follow != "" {
+		h.startFollower(h.cfg.Follow)
 	}
-
-	if h.cfg.AuthToken != "" && r.Header.Get("x-auth-token") != h.cfg.AuthToken {
-		h.retErr(w, "permission denied")
-		return
+	go h.webhooks.Run(h.done)
+	if h.certs != nil {
+		go h.certs.Watch(h.done)
 	}
-
-	if r.Method == http.MethodGet {
-
-		if r.URL.Path == "/v1/task/get/all" {
-			ch := make(chan *db.Task)
-			go h.db.GetTasks(ch, "q")
-			for t := range ch {
-				json, _ := json.Marshal(t)
-				w.Write(json)
-				w.Write([]byte("\n"))
-			}
-			return
-
-		} else if r.URL.Path == "/v1/task/get/active" {
-			for _, s := range []int{1, 2} {
-				ch := make(chan *db.Task)
-				go h.db.GetTasks(ch, "state", s)
-				for t := range ch {
-					json, _ := json.Marshal(t)
-					w.Write(json)
-					w.Write([]byte("\n"))
+	go func() {
+		for range time.Tick(time.Minute) {
+			h.limiter.prune()
+		}
+	}()
+	if h.cfg.HistoryRetention > 0 {
+		go func() {
+			for range time.Tick(time.Minute) {
+				if h.getFollower() != nil || h.cluster != nil && !h.cluster.IsLeader() {
+					continue // the leader prunes
 				}
-			}
-			return
-
-		} else if r.URL.Path == "/v1/task/get/done" {
-			ch := make(chan *db.Task)
-			go h.db.GetTasks(ch, "state", 3)
-			for t := range ch {
-				json, _ := json.Marshal(t)
-				w.Write(json)
-				w.Write([]byte("\n"))
-			}
-			return
-
-		} else if r.URL.Path == "/v1/task/get/" {
-			index := ""
-			arg := ""
-			if r.URL.Query().Get("id") != "" {
-				index = "id"
-				arg = r.URL.Query().Get("id")
-			}
-			if r.URL.Query().Get("sticker") != "" {
-				if index != "" {
-					h.retErr(w, "only one index posible")
-					return
+				before := time.Now().Add(-time.Duration(h.cfg.HistoryRetention) * time.Second)
+				if err := h.db.PruneHistory(uint64(before.Unix())); err != nil {
+					log.Print(err)
 				}
-				index = "sticker"
-				arg = r.URL.Query().Get("sticker")
-			}
-			if index == "" {
-				h.retErr(w, "index not specified")
-				return
-			}
-			ch := make(chan *db.Task)
-			go h.db.GetTasks(ch, index, arg)
-			for t := range ch {
-				json, _ := json.Marshal(t)
-				w.Write(json)
-				w.Write([]byte("\n"))
-			}
-			return
-
-		}
-
-	} else if r.Method == http.MethodPost {
-
-		if h.safeMode {
-			h.retErrCode(w, http.StatusServiceUnavailable, "server in safemode")
-			w.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			h.retErr(w, "can't get body")
-			return
-		}
-
-		if r.URL.Path == "/v1/task/insert" {
-			task := h.db.EmptyTask()
-			err = json.Unmarshal(body, &task)
-			if err != nil {
-				h.retErr(w, "can't parse body json: "+err.Error())
-				return
-			}
-			err := h.db.InsertTasks([]*db.Task{&task})
-			if err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			w.WriteHeader(http.StatusOK)
-			type OkData struct {
-				Result string `json:"result"`
-				Id     string `json:"id"`
-			}
-			okData, _ := json.Marshal(OkData{"ok", task.Id})
-			w.Write(okData)
-			w.Write([]byte("\n"))
-			return
-
-		} else if r.URL.Path == "/v1/task/acquire" {
-			type PostData struct {
-				Worker string `json:"worker"`
-			}
-			postData := &PostData{}
-			err = json.Unmarshal(body, postData)
-			if err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			task, err := h.db.AcquireTask(postData.Worker)
-			if err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			type OkData struct {
-				Result string   `json:"result"`
-				Task   *db.Task `json:"task"`
-			}
-			json, _ := json.Marshal(OkData{"ok", task})
-			w.Write(json)
-			return
-
-		} else if r.URL.Path == "/v1/task/update" || r.URL.Path == "/v1/task/done" || r.URL.Path == "/v1/task/refuse" {
-			state := 2
-			if r.URL.Path == "/v1/task/done" {
-				state = 3
-			} else if r.URL.Path == "/v1/task/refuse" {
-				state = 0
-			}
-			type PostData struct {
-				Id     string `json:"id"`
-				Worker string `json:"worker"`
-				Error  bool   `json:"error"`
-				Status string `json:"status"`
-			}
-			postData := &PostData{}
-			err = json.Unmarshal(body, postData)
-			if err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			if state == 3 && postData.Error {
-				state = 4
-			}
-			task, err := h.db.GetTask("id", postData.Id)
-			if err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			if task == nil {
-				h.retErr(w, "task not found")
-				return
-			}
-			if task.State == 0 {
-				h.retErr(w, "task not acquired")
-				return
-			}
-			if task.State > 2 {
-				h.retErr(w, "task already done")
-				return
-			}
-			if postData.Worker != task.Worker {
-				h.retErr(w, "task worker mismatch")
-				return
-			}
-			if err := h.db.UpdateTask(task, state, postData.Status); err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			w.Write([]byte(`{"result":"ok"}` + "\n"))
-			return
-
-		} else if r.URL.Path == "/v1/task/delete" {
-			type PostData struct {
-				Id string `json:"id"`
-			}
-			postData := &PostData{}
-			err = json.Unmarshal(body, postData)
-			if err != nil {
-				h.retErr(w, err.Error())
-				return
 			}
-			task, err := h.db.GetTask("id", postData.Id)
-			if err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			if task == nil {
-				h.retErr(w, "task not found")
-				return
-			}
-
-			if err := h.db.DeleteTask(task); err != nil {
-				h.retErr(w, err.Error())
-				return
-			}
-			w.Write([]byte(`{"result":"ok"}` + "\n"))
-			return
+		}()
+	}
+	h.safeMode = false
+}
 
-		}
+// TLSConfig returns the config of the https listener, nil for plain http.
+func (h *Handler) TLSConfig() *tls.Config {
+	if h.certs == nil {
+		return nil
 	}
+	return h.certs.ServerConfig()
+}
 
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("not found\n"))
+// ReloadCerts reads the tls files again, e.g. on SIGHUP.
+func (h *Handler) ReloadCerts() {
+	if h.certs == nil {
+		return
+	}
+	if err := h.certs.Reload(); err != nil {
+		log.Printf("tls: reload failed: %s", err)
+	}
 }
 
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
@@ -274,30 +145,20 @@ func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (h *Handler) retErr(w http.ResponseWriter, errs ...string) {
-	h.retErrCode(w, http.StatusBadRequest, errs...)
-}
-
-func (h *Handler) retErrCode(w http.ResponseWriter, code int, errs ...string) {
-	for _, v := range errs {
-		log.Print(v)
-	}
-	type ErrorsData struct {
-		Errors []string `json:"errors"`
-	}
-	errData, _ := json.Marshal(ErrorsData{
-		Errors: errs,
-	})
-	w.Header().Set("content-type", "application/json")
-	w.WriteHeader(code)
-	w.Write(errData)
-	w.Write([]byte("\n"))
-}
-
 func (h *Handler) Terminate() {
 	h.safeMode = true
+	close(h.done) // stop event streams
+	if f := h.getFollower(); f != nil {
+		f.cancel()
+		<-f.done
+	}
 	h.wg.Wait()
 	if h.cfg.SnapshotPath != "" {
 		h.db.WriteSnapshot(h.cfg.SnapshotPath)
 	}
+	if h.cluster != nil {
+		if err := h.cluster.Shutdown(); err != nil {
+			log.Print(err)
+		}
+	}
 }
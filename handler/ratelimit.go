@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boiler/ciri/metrics"
+)
+
+// limiter keeps a token bucket per client, a named token or an ip.
+type limiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  float64
+}
+
+func newLimiter() *limiter {
+	return &limiter{buckets: make(map[string]*bucket)}
+}
+
+// allow takes a request from the bucket of the key. If the bucket is empty
+// it returns the time until the next request is allowed.
+func (l *limiter) allow(key string, rate float64, burst int) (bool, time.Duration) {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.rate, b.burst = rate, float64(burst)
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops the buckets refilled by now, they start full anyway.
+func (l *limiter) prune() {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allowRequest applies the rate limit of the token, or of the client ip for
+// requests without a named token, and writes 429 if it is exceeded.
+func (h *Handler) allowRequest(w http.ResponseWriter, r *http.Request, tok *token) bool {
+	rate, burst := h.cfg.RateLimit, h.cfg.RateBurst
+	key, name := "", ""
+	if tok != nil && tok.name != "" {
+		key, name = "token "+tok.name, tok.name
+		if tok.rate > 0 {
+			rate, burst = tok.rate, tok.burst
+		}
+	} else {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		key = "ip " + ip
+	}
+	if rate <= 0 {
+		return true
+	}
+	ok, wait := h.limiter.allow(key, rate, burst)
+	if ok {
+		return true
+	}
+	metrics.CountAdd("requests_rejected", 1, "rate_limit", name)
+	w.Header().Set("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	h.retErrCode(w, CodeRateLimited, "rate limit exceeded")
+	return false
+}
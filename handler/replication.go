@@ -0,0 +1,308 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boiler/ciri/db"
+)
+
+// follower replicates the leader: it loads the leader snapshot, then
+// applies the streamed changes until promoted.
+type follower struct {
+	leader string
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mutex     sync.Mutex
+	logId     string // change log id of the leader
+	seq       uint64 // last leader change applied
+	connected bool
+	lastError string
+}
+
+type ReplicationStatus struct {
+	Role      string `json:"role"` // leader or follower
+	Leader    string `json:"leader,omitempty"`
+	Seq       uint64 `json:"seq"` // last change of this instance
+	LeaderSeq uint64 `json:"leader_seq,omitempty"`
+	Connected bool   `json:"connected,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// ReplicationSnapshot streams the snapshot for a new follower, the
+// x-ciri-seq header holds the seq of the last change it includes.
+func (h *Handler) ReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	seq, encode := h.db.ReplicaSnapshot()
+	w.Header().Set("content-type", "application/octet-stream")
+	w.Header().Set("x-ciri-log", h.db.Changes().Id)
+	w.Header().Set("x-ciri-seq", strconv.FormatUint(seq, 10))
+	bw := bufio.NewWriter(w)
+	if _, err := encode(bw); err != nil {
+		log.Printf("replication snapshot failed: %s", err)
+		return
+	}
+	bw.Flush()
+}
+
+// ReplicationStream streams changes after the since seq as NDJSON, blank
+// lines are keepalives. 410 tells the follower to load the snapshot again.
+func (h *Handler) ReplicationStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.retErr(w, "streaming not supported")
+		return
+	}
+	changeLog := h.db.Changes()
+	q := r.URL.Query()
+	seq, err := strconv.ParseUint(q.Get("since"), 10, 64)
+	if err != nil {
+		h.retErr(w, "bad since: "+q.Get("since"))
+		return
+	}
+	if q.Get("log") != changeLog.Id {
+		h.retErrCode(w, CodeGone, "change log restarted")
+		return
+	}
+	if _, ok := changeLog.Since(seq); !ok {
+		h.retErrCode(w, CodeGone, "changes not available since "+q.Get("since"))
+		return
+	}
+
+	ch, cancel := changeLog.Subscribe()
+	defer cancel()
+	ping := time.NewTicker(15 * time.Second)
+	defer ping.Stop()
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		changes, ok := changeLog.Since(seq)
+		if !ok {
+			// the follower is too slow, it reconnects and gets 410
+			return
+		}
+		for _, c := range changes {
+			seq = c.Seq
+			json, _ := json.Marshal(c)
+			w.Write(json)
+			w.Write([]byte("\n"))
+		}
+		flusher.Flush()
+
+		select {
+		case <-ch:
+		case <-ping.C:
+			w.Write([]byte("\n"))
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *Handler) ReplicationStatus() *ReplicationStatus {
+	status := &ReplicationStatus{
+		Role: "leader",
+		Seq:  h.db.Changes().LastSeq(),
+	}
+	if f := h.getFollower(); f != nil {
+		f.mutex.Lock()
+		status.Role = "follower"
+		status.Leader = f.leader
+		status.LeaderSeq = f.seq
+		status.Connected = f.connected
+		status.LastError = f.lastError
+		f.mutex.Unlock()
+	}
+	return status
+}
+
+func (h *Handler) getFollower() *follower {
+	h.followerMutex.Lock()
+	defer h.followerMutex.Unlock()
+	return h.follower
+}
+
+// startFollower starts replicating the leader in the background.
+func (h *Handler) startFollower(leader string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		leader: strings.TrimRight(leader, "/"),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	h.followerMutex.Lock()
+	h.follower = f
+	h.followerMutex.Unlock()
+	log.Printf("following leader: %s", f.leader)
+	go func() {
+		defer close(f.done)
+		h.follow(ctx, f)
+	}()
+}
+
+// Promote stops the replication, so that the instance takes writes. It
+// waits for the change being applied, if any.
+func (h *Handler) Promote() error {
+	h.followerMutex.Lock()
+	f := h.follower
+	h.follower = nil
+	h.followerMutex.Unlock()
+	if f == nil {
+		return fmt.Errorf("not a follower")
+	}
+	f.cancel()
+	<-f.done
+	log.Printf("promoted to leader, leader seq: %d", f.seq)
+	return nil
+}
+
+func (h *Handler) follow(ctx context.Context, f *follower) {
+	delay := time.Second
+	for {
+		err := h.replicate(ctx, f)
+		if ctx.Err() != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.connected = false
+		if err != nil {
+			f.lastError = err.Error()
+			log.Printf("replication: %s", err)
+		}
+		f.mutex.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay < 30*time.Second {
+			delay *= 2
+		}
+		if err == nil {
+			delay = time.Second
+		}
+	}
+}
+
+// replicate loads the snapshot unless already done for the current leader
+// log, then applies the streamed changes until the stream ends.
+func (h *Handler) replicate(ctx context.Context, f *follower) error {
+	f.mutex.Lock()
+	logId, seq := f.logId, f.seq
+	f.mutex.Unlock()
+
+	if logId == "" {
+		resp, err := h.leaderGet(ctx, f, "/v1/replication/snapshot")
+		if err != nil {
+			return err
+		}
+		seq, err = strconv.ParseUint(resp.Header.Get("x-ciri-seq"), 10, 64)
+		if err != nil {
+			resp.Body.Close()
+			return fmt.Errorf("bad snapshot seq: %s", resp.Header.Get("x-ciri-seq"))
+		}
+		logId = resp.Header.Get("x-ciri-log")
+		_, err = h.db.LoadReplica(bufio.NewReader(resp.Body))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		f.mutex.Lock()
+		f.logId, f.seq = logId, seq
+		f.mutex.Unlock()
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	path := fmt.Sprintf("/v1/replication/stream?since=%d&log=%s", seq, url.QueryEscape(logId))
+	resp, err := h.leaderGet(streamCtx, f, path)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusGone {
+			f.mutex.Lock()
+			f.logId = "" // load the snapshot again
+			f.mutex.Unlock()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	f.mutex.Lock()
+	f.connected = true
+	f.lastError = ""
+	f.mutex.Unlock()
+
+	// the leader pings every 15 seconds, reconnect if it goes silent
+	watchdog := time.AfterFunc(time.Minute, cancel)
+	defer watchdog.Stop()
+	reader := bufio.NewReader(resp.Body)
+	batch := []*db.Change{}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if ctx.Err() == nil && streamCtx.Err() != nil {
+				return fmt.Errorf("leader stream timeout")
+			}
+			return err
+		}
+		watchdog.Reset(time.Minute)
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		c := &db.Change{}
+		if err := json.Unmarshal(line, c); err != nil {
+			return err
+		}
+		batch = append(batch, c)
+		if !c.Commit {
+			continue
+		}
+		if err := h.db.ApplyChanges(batch); err != nil {
+			f.mutex.Lock()
+			f.logId = "" // diverged, load the snapshot again
+			f.mutex.Unlock()
+			return err
+		}
+		f.mutex.Lock()
+		f.seq = c.Seq
+		f.mutex.Unlock()
+		batch = batch[:0]
+	}
+}
+
+// leaderGet returns the successful response of the leader. On error the
+// response is returned with a closed body, so that the status can be checked.
+func (h *Handler) leaderGet(ctx context.Context, f *follower, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := h.cfg.NodeToken(); token != "" {
+		req.Header.Set("x-auth-token", token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errData struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errData)
+		resp.Body.Close()
+		return resp, fmt.Errorf("leader %s: http status %d %s", path, resp.StatusCode, strings.Join(errData.Errors, "; "))
+	}
+	return resp, nil
+}
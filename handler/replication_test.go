@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boiler/ciri/config"
+)
+
+func newTestConfig() *config.Config {
+	return &config.Config{
+		AuthToken:                "secret",
+		DefaultPoolMaxSize:       8,
+		DefaultPoolMaxResultSize: 65536,
+		EventBufferSize:          1024,
+		WebhookQueueSize:         100,
+		WebhookLogSize:           100,
+		ReplicationLogSize:       1000,
+		MaxBodySize:              1 << 20,
+	}
+}
+
+// startServer runs a handler of cfg on a loopback listener until the test
+// ends.
+func startServer(t *testing.T, cfg *config.Config) (*Handler, *httptest.Server) {
+	t.Helper()
+	h := New(cfg)
+	h.Init()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	t.Cleanup(h.Terminate) // ends the streams before srv.Close waits for them
+	return h, srv
+}
+
+// call sends the request with the auth token and returns the status and
+// the body; redirects are not followed.
+func call(t *testing.T, srv *httptest.Server, method string, path string, body string) (int, http.Header, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("x-auth-token", "secret")
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header, string(data)
+}
+
+// waitTask waits until the task is readable on srv.
+func waitTask(t *testing.T, srv *httptest.Server, id string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, _, _ := call(t, srv, http.MethodGet, "/v2/tasks/"+id, "")
+		if status == http.StatusOK {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s not replicated", id)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	_, leader := startServer(t, newTestConfig())
+	// t1 comes with the snapshot, t2 with the change stream
+	if status, _, body := call(t, leader, http.MethodPost, "/v2/tasks", `{"id":"t1"}`); status != http.StatusCreated {
+		t.Fatalf("insert on the leader: %d %s", status, body)
+	}
+	cfg := newTestConfig()
+	cfg.Follow = leader.URL
+	follower, replica := startServer(t, cfg)
+	waitTask(t, replica, "t1")
+	if status, _, body := call(t, leader, http.MethodPost, "/v2/tasks", `{"id":"t2"}`); status != http.StatusCreated {
+		t.Fatalf("insert on the leader: %d %s", status, body)
+	}
+	waitTask(t, replica, "t2")
+
+	// writes go to the leader
+	status, header, body := call(t, replica, http.MethodPost, "/v2/tasks", `{"id":"t3"}`)
+	if status != http.StatusTemporaryRedirect || header.Get("location") != leader.URL+"/v2/tasks" {
+		t.Errorf("insert on the follower: %d, location %q, %s", status, header.Get("location"), body)
+	}
+	if status, _, _ := call(t, replica, http.MethodGet, "/v2/tasks/t3", ""); status != http.StatusNotFound {
+		t.Errorf("task refused by the follower stored: %d", status)
+	}
+
+	status, _, body = call(t, replica, http.MethodGet, "/v1/replication/status", "")
+	var res struct {
+		Status *ReplicationStatus `json:"status"`
+	}
+	json.Unmarshal([]byte(body), &res)
+	if status != http.StatusOK || res.Status == nil || res.Status.Role != "follower" || res.Status.Leader != leader.URL {
+		t.Errorf("follower status: %d %s", status, body)
+	}
+
+	if status, _, body := call(t, replica, http.MethodPost, "/v1/admin/promote", ""); status != http.StatusOK {
+		t.Fatalf("promote: %d %s", status, body)
+	}
+	if follower.getFollower() != nil {
+		t.Error("follower still replicating after promotion")
+	}
+	if status, _, body := call(t, replica, http.MethodPost, "/v2/tasks", `{"id":"t3"}`); status != http.StatusCreated {
+		t.Errorf("insert after promotion: %d %s", status, body)
+	}
+	if status, _, body := call(t, replica, http.MethodPost, "/v1/admin/promote", ""); status != http.StatusBadRequest {
+		t.Errorf("second promote: %d %s", status, body)
+	}
+}
@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/boiler/ciri/db"
+	"github.com/boiler/ciri/metrics"
+)
+
+// Codes of the error responses, {"errors":[...],"code":"not_found"}.
+const (
+	CodeBadRequest       = "bad_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeGone             = "gone"
+	CodeTooLarge         = "payload_too_large"
+	CodeRateLimited      = "rate_limited"
+	CodeReadOnly         = "read_only"
+	CodeBadGateway       = "bad_gateway"
+	CodeUnavailable      = "unavailable"
+	CodeSafemode         = "safemode" // the change was not applied, clients retry it
+	CodeInternal         = "internal"
+)
+
+var codeStatus = map[string]int{
+	CodeBadRequest:       http.StatusBadRequest,
+	CodeUnauthorized:     http.StatusUnauthorized,
+	CodeForbidden:        http.StatusForbidden,
+	CodeNotFound:         http.StatusNotFound,
+	CodeMethodNotAllowed: http.StatusMethodNotAllowed,
+	CodeConflict:         http.StatusConflict,
+	CodeGone:             http.StatusGone,
+	CodeTooLarge:         http.StatusRequestEntityTooLarge,
+	CodeRateLimited:      http.StatusTooManyRequests,
+	CodeReadOnly:         http.StatusTemporaryRedirect,
+	CodeBadGateway:       http.StatusBadGateway,
+	CodeUnavailable:      http.StatusServiceUnavailable,
+	CodeSafemode:         http.StatusServiceUnavailable,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// request is the state of an API request passed to the route functions.
+type request struct {
+	tok    *token
+	db     *db.DB            // view of h.db with the token name as the actor
+	body   []byte            // of the requests other than GET
+	params map[string]string // values of the {name} path segments
+	v2     bool
+}
+
+type routeFunc func(w http.ResponseWriter, r *http.Request, req *request)
+
+// route is an endpoint of the API, {name} segments of the path match any
+// value. Requests other than GET change the state, they are served by the
+// leader unless local is set.
+type route struct {
+	method string
+	path   string
+	role   string
+	scoped bool // checks the token scope itself, denied to scoped tokens otherwise
+	local  bool
+	fn     routeFunc
+}
+
+// newRoutes returns the routes in the order of matching, so literal
+// segments go before {name} ones.
+func (h *Handler) newRoutes() []*route {
+	get, post := http.MethodGet, http.MethodPost
+	events := func(w http.ResponseWriter, r *http.Request, req *request) {
+		h.Events(w, r, req.tok)
+	}
+	replicationSnapshot := func(w http.ResponseWriter, r *http.Request, req *request) {
+		h.ReplicationSnapshot(w, r)
+	}
+	replicationStream := func(w http.ResponseWriter, r *http.Request, req *request) {
+		h.ReplicationStream(w, r)
+	}
+	return []*route{
+		{method: get, path: "/v1/task/get/all", role: RoleProducer, scoped: true, fn: h.taskGetAll},
+		{method: get, path: "/v1/task/get/active", role: RoleProducer, scoped: true, fn: h.taskGetActive},
+		{method: get, path: "/v1/task/get/done", role: RoleProducer, scoped: true, fn: h.taskGetDone},
+		{method: get, path: "/v1/task/get/", role: RoleProducer, scoped: true, fn: h.taskGet},
+		{method: get, path: "/v1/task/query", role: RoleProducer, scoped: true, fn: h.taskQuery},
+		{method: get, path: "/v1/task/history", role: RoleProducer, scoped: true, fn: h.taskHistory},
+		{method: get, path: "/v1/task/deps", role: RoleProducer, scoped: true, fn: h.taskDeps},
+		{method: get, path: "/v1/group/get", role: RoleProducer, fn: h.groupGet},
+		{method: get, path: "/v1/pool/list", role: RoleProducer, scoped: true, fn: h.poolList},
+		{method: get, path: "/v1/stats", role: RoleProducer, fn: h.stats},
+		{method: get, path: "/v1/events", role: RoleProducer, scoped: true, fn: events},
+		{method: get, path: "/v1/webhook/deliveries", role: RoleAdmin, fn: h.webhookDeliveries},
+		{method: get, path: "/v1/cluster/status", role: RoleAdmin, fn: h.clusterStatus},
+		{method: get, path: "/v1/replication/snapshot", role: RoleAdmin, fn: replicationSnapshot},
+		{method: get, path: "/v1/replication/stream", role: RoleAdmin, fn: replicationStream},
+		{method: get, path: "/v1/replication/status", role: RoleAdmin, fn: h.replicationStatus},
+		{method: get, path: "/v1/admin/export", role: RoleAdmin, scoped: true, fn: h.adminExport},
+		{method: get, path: "/v1/admin/snapshot/status", role: RoleAdmin, fn: h.adminSnapshotStatus},
+
+		{method: post, path: "/v1/task/insert", role: RoleProducer, scoped: true, fn: h.taskInsert},
+		{method: post, path: "/v1/group/insert", role: RoleProducer, scoped: true, fn: h.groupInsert},
+		{method: post, path: "/v1/task/cancel", role: RoleProducer, scoped: true, fn: h.taskCancel},
+		{method: post, path: "/v1/task/edit", role: RoleProducer, scoped: true, fn: h.taskEdit},
+		{method: post, path: "/v1/task/acquire", role: RoleWorker, scoped: true, fn: h.taskAcquire},
+		{method: post, path: "/v1/task/update", role: RoleWorker, scoped: true, fn: h.taskUpdate},
+		{method: post, path: "/v1/task/done", role: RoleWorker, scoped: true, fn: h.taskUpdate},
+		{method: post, path: "/v1/task/refuse", role: RoleWorker, scoped: true, fn: h.taskUpdate},
+		{method: post, path: "/v1/task/requeue", role: RoleAdmin, scoped: true, fn: h.taskRequeue},
+		{method: post, path: "/v1/task/delete", role: RoleAdmin, scoped: true, fn: h.taskDelete},
+		{method: post, path: "/v1/task/result/purge", role: RoleAdmin, fn: h.taskResultPurge},
+		{method: post, path: "/v1/task/bulk", role: RoleAdmin, fn: h.taskBulk},
+		{method: post, path: "/v1/pool/pause", role: RoleAdmin, scoped: true, fn: h.poolPause},
+		{method: post, path: "/v1/cluster/join", role: RoleAdmin, fn: h.clusterMember},
+		{method: post, path: "/v1/cluster/remove", role: RoleAdmin, fn: h.clusterMember},
+		{method: post, path: "/v1/admin/snapshot", role: RoleAdmin, local: true, fn: h.adminSnapshot},
+		{method: post, path: "/v1/admin/promote", role: RoleAdmin, local: true, fn: h.adminPromote},
+		{method: post, path: "/v1/admin/import", role: RoleAdmin, scoped: true, fn: h.adminImport},
+
+		{method: get, path: "/v2/tasks", role: RoleProducer, scoped: true, fn: h.v2TaskList},
+		{method: post, path: "/v2/tasks", role: RoleProducer, scoped: true, fn: h.v2TaskInsert},
+		{method: get, path: "/v2/tasks/{id}", role: RoleProducer, scoped: true, fn: h.v2TaskGet},
+		{method: http.MethodPatch, path: "/v2/tasks/{id}", role: RoleProducer, scoped: true, fn: h.v2TaskEdit},
+		{method: http.MethodDelete, path: "/v2/tasks/{id}", role: RoleAdmin, scoped: true, fn: h.v2TaskDelete},
+		{method: get, path: "/v2/tasks/{id}/history", role: RoleProducer, scoped: true, fn: h.v2TaskHistory},
+		{method: get, path: "/v2/tasks/{id}/deps", role: RoleProducer, scoped: true, fn: h.v2TaskDeps},
+		{method: post, path: "/v2/tasks/{id}/cancel", role: RoleProducer, scoped: true, fn: h.v2TaskCancel},
+		{method: post, path: "/v2/tasks/{id}/requeue", role: RoleAdmin, scoped: true, fn: h.v2TaskRequeue},
+		{method: post, path: "/v2/tasks/{id}/update", role: RoleWorker, scoped: true, fn: h.v2TaskUpdate},
+		{method: post, path: "/v2/tasks/{id}/done", role: RoleWorker, scoped: true, fn: h.v2TaskUpdate},
+		{method: post, path: "/v2/tasks/{id}/refuse", role: RoleWorker, scoped: true, fn: h.v2TaskUpdate},
+		{method: post, path: "/v2/workers/{worker}/acquire", role: RoleWorker, scoped: true, fn: h.v2TaskAcquire},
+		{method: post, path: "/v2/groups", role: RoleProducer, scoped: true, fn: h.v2GroupInsert},
+		{method: get, path: "/v2/groups/{id}", role: RoleProducer, fn: h.v2GroupGet},
+		{method: get, path: "/v2/pools", role: RoleProducer, scoped: true, fn: h.v2PoolList},
+		{method: post, path: "/v2/pools/{pool}/pause", role: RoleAdmin, scoped: true, fn: h.v2PoolPause},
+		{method: post, path: "/v2/pools/{pool}/resume", role: RoleAdmin, scoped: true, fn: h.v2PoolPause},
+		{method: get, path: "/v2/stats", role: RoleProducer, fn: h.stats},
+		{method: get, path: "/v2/events", role: RoleProducer, scoped: true, fn: events},
+	}
+}
+
+// match returns the values of the {name} segments if the path matches.
+func (rt *route) match(path string) (map[string]string, bool) {
+	want := strings.Split(rt.path, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, s := range want {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			if got[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[s[1:len(s)-1]] = got[i]
+		} else if s != got[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// findRoute returns the route of the request, or the methods allowed for
+// the path if only the method doesn't match.
+func (h *Handler) findRoute(method string, path string) (*route, map[string]string, []string) {
+	allowed := []string{}
+	for _, rt := range h.routes {
+		params, ok := rt.match(path)
+		if !ok {
+			continue
+		}
+		if rt.method == method {
+			return rt, params, nil
+		}
+		allowed = append(allowed, rt.method)
+	}
+	sort.Strings(allowed)
+	return nil, nil, allowed
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.wg.Add(1)
+	defer h.wg.Done()
+	w.Header().Set("content-type", "application/json")
+
+	if r.Method == http.MethodGet && r.URL.Path == "/health" {
+		h.Health(w, r)
+		return
+	}
+
+	req := &request{v2: strings.HasPrefix(r.URL.Path, "/v2/")}
+	tok := h.authenticate(r)
+	if !h.allowRequest(w, r, tok) {
+		return
+	}
+	if tok == nil {
+		h.fail(w, req, CodeUnauthorized, "permission denied")
+		return
+	}
+	rt, params, allowed := h.findRoute(r.Method, r.URL.Path)
+	if rt == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("allow", strings.Join(allowed, ", "))
+			h.writeErr(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed: "+r.Method)
+			return
+		}
+		h.writeErr(w, http.StatusNotFound, CodeNotFound, "not found: "+r.URL.Path)
+		return
+	}
+	if !tok.hasRole(rt.role) || tok.scoped() && !rt.scoped {
+		h.retForbidden(w, fmt.Sprintf("token %s: permission denied: %s", tok.name, r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodGet && tok.name != "" {
+		log.Printf("token %s: %s %s", tok.name, r.Method, r.URL.Path)
+	}
+	req.tok = tok
+	req.db = h.db.WithActor(tok.name)
+	req.params = params
+
+	if r.Method != http.MethodGet {
+		if h.safeMode {
+			h.retErrCode(w, CodeSafemode, "server in safemode")
+			return
+		}
+		if h.cluster != nil && !h.cluster.IsLeader() && !rt.local {
+			h.forwardToLeader(w, r)
+			return
+		}
+		if f := h.getFollower(); f != nil && !rt.local {
+			// read-only follower, clients may repeat the request on the leader
+			w.Header().Set("location", f.leader+r.URL.RequestURI())
+			h.retErrCode(w, CodeReadOnly, "read-only follower, leader: "+f.leader)
+			return
+		}
+		if limit := h.cfg.GetMaxBodySize(rt.path); limit > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				metrics.CountAdd("requests_rejected", 1, "body_size", tok.name)
+				h.retErrCode(w, CodeTooLarge, fmt.Sprintf("request body larger than %d bytes", maxBytesErr.Limit))
+				return
+			}
+			h.retErr(w, "can't get body")
+			return
+		}
+		req.body = body
+	}
+	rt.fn(w, r, req)
+}
+
+// fail writes the error with the status of the code. The v1 routes keep
+// returning 400 for the errors they did before the codes were added.
+func (h *Handler) fail(w http.ResponseWriter, req *request, code string, msg string) {
+	status := codeStatus[code]
+	if !req.v2 && (code == CodeUnauthorized || code == CodeNotFound || code == CodeConflict) {
+		status = http.StatusBadRequest
+	}
+	h.writeErr(w, status, code, msg)
+}
+
+// failErr writes the db error with the code of its kind.
+func (h *Handler) failErr(w http.ResponseWriter, req *request, err error) {
+	h.fail(w, req, errCode(err), err.Error())
+}
+
+// errCode returns the code of the db error kind, bad_request for the others.
+func errCode(err error) string {
+	switch db.ErrorKind(err) {
+	case db.KindNotFound:
+		return CodeNotFound
+	case db.KindConflict:
+		return CodeConflict
+	case db.KindForbidden:
+		return CodeForbidden
+	case db.KindTooLarge:
+		return CodeTooLarge
+	case db.KindUnavailable:
+		return CodeUnavailable
+	}
+	return CodeBadRequest
+}
+
+func (h *Handler) retErr(w http.ResponseWriter, errs ...string) {
+	h.writeErr(w, http.StatusBadRequest, CodeBadRequest, errs...)
+}
+
+// retErrCode writes the errors with the status of the code.
+func (h *Handler) retErrCode(w http.ResponseWriter, code string, errs ...string) {
+	h.writeErr(w, codeStatus[code], code, errs...)
+}
+
+func (h *Handler) writeErr(w http.ResponseWriter, status int, code string, errs ...string) {
+	for _, v := range errs {
+		log.Print(v)
+	}
+	type ErrorsData struct {
+		Errors []string `json:"errors"`
+		Code   string   `json:"code"`
+	}
+	errData, _ := json.Marshal(ErrorsData{
+		Errors: errs,
+		Code:   code,
+	})
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(errData)
+	w.Write([]byte("\n"))
+}
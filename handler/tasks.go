@@ -0,0 +1,708 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/boiler/ciri/db"
+)
+
+func (h *Handler) taskGetAll(w http.ResponseWriter, r *http.Request, req *request) {
+	ch := make(chan *db.Task)
+	go req.db.GetTasks(ch, "q")
+	for t := range ch {
+		if !req.tok.allows(t) {
+			continue
+		}
+		json, _ := json.Marshal(t)
+		w.Write(json)
+		w.Write([]byte("\n"))
+	}
+}
+
+func (h *Handler) taskGetActive(w http.ResponseWriter, r *http.Request, req *request) {
+	for _, s := range []int{1, 2} {
+		ch := make(chan *db.Task)
+		go req.db.GetTasks(ch, "state", s)
+		for t := range ch {
+			if !req.tok.allows(t) {
+				continue
+			}
+			json, _ := json.Marshal(t)
+			w.Write(json)
+			w.Write([]byte("\n"))
+		}
+	}
+}
+
+func (h *Handler) taskGetDone(w http.ResponseWriter, r *http.Request, req *request) {
+	ch := make(chan *db.Task)
+	go req.db.GetTasks(ch, "state", 3)
+	for t := range ch {
+		if !req.tok.allows(t) {
+			continue
+		}
+		json, _ := json.Marshal(t)
+		w.Write(json)
+		w.Write([]byte("\n"))
+	}
+}
+
+func (h *Handler) taskGet(w http.ResponseWriter, r *http.Request, req *request) {
+	index := ""
+	arg := ""
+	if r.URL.Query().Get("id") != "" {
+		index = "id"
+		arg = r.URL.Query().Get("id")
+	}
+	if r.URL.Query().Get("sticker") != "" {
+		if index != "" {
+			h.retErr(w, "only one index posible")
+			return
+		}
+		index = "sticker"
+		arg = r.URL.Query().Get("sticker")
+	}
+	if index == "" {
+		h.retErr(w, "index not specified")
+		return
+	}
+	ch := make(chan *db.Task)
+	go req.db.GetTasks(ch, index, arg)
+	for t := range ch {
+		if !req.tok.allows(t) {
+			continue
+		}
+		json, _ := json.Marshal(t)
+		w.Write(json)
+		w.Write([]byte("\n"))
+	}
+}
+
+func (h *Handler) poolList(w http.ResponseWriter, r *http.Request, req *request) {
+	pools, err := h.getPools(req)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	type OkData struct {
+		Result string     `json:"result"`
+		Pools  []*db.Pool `json:"pools"`
+	}
+	json, _ := json.Marshal(OkData{"ok", pools})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskQuery(w http.ResponseWriter, r *http.Request, req *request) {
+	tasks, cursor, err := h.queryTasks(r, req)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	type OkData struct {
+		Result string     `json:"result"`
+		Tasks  []*db.Task `json:"tasks"`
+		Cursor string     `json:"cursor,omitempty"`
+	}
+	json, _ := json.Marshal(OkData{"ok", tasks, cursor})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request, req *request) {
+	filter, err := db.ParseFilter(r.URL.Query())
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	groupBy := []string{}
+	if v := r.URL.Query().Get("group_by"); v != "" {
+		groupBy = strings.Split(v, ",")
+	}
+	stats, err := req.db.GetStats(filter, groupBy)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	json, _ := json.Marshal(stats)
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) groupGet(w http.ResponseWriter, r *http.Request, req *request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		h.retErr(w, "index not specified")
+		return
+	}
+	status, err := req.db.GetGroupStatus(id)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if status == nil {
+		h.fail(w, req, CodeNotFound, "group not found")
+		return
+	}
+	json, _ := json.Marshal(status)
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskHistory(w http.ResponseWriter, r *http.Request, req *request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		h.retErr(w, "index not specified")
+		return
+	}
+	if !h.checkScope(w, req, id) {
+		return
+	}
+	history, err := req.db.GetHistory(id)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if history == nil {
+		h.fail(w, req, CodeNotFound, "task not found")
+		return
+	}
+	json, _ := json.Marshal(history)
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskDeps(w http.ResponseWriter, r *http.Request, req *request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		h.retErr(w, "index not specified")
+		return
+	}
+	if !h.checkScope(w, req, id) {
+		return
+	}
+	nodes, err := req.db.GetTaskGraph(id)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if nodes == nil {
+		h.fail(w, req, CodeNotFound, "task not found")
+		return
+	}
+	type OkData struct {
+		Result string         `json:"result"`
+		Id     string         `json:"id"`
+		Nodes  []*db.TaskNode `json:"nodes"`
+	}
+	json, _ := json.Marshal(OkData{"ok", id, nodes})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskInsert(w http.ResponseWriter, r *http.Request, req *request) {
+	task := req.db.EmptyTask()
+	err := json.Unmarshal(req.body, &task)
+	if err != nil {
+		h.retErr(w, "can't parse body json: "+err.Error())
+		return
+	}
+	if !req.tok.allows(&task) {
+		h.retForbidden(w, "task out of token scope")
+		return
+	}
+	if err := req.db.InsertTasks([]*db.Task{&task}); err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	type OkData struct {
+		Result string `json:"result"`
+		Id     string `json:"id"`
+	}
+	okData, _ := json.Marshal(OkData{"ok", task.Id})
+	w.Write(okData)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) groupInsert(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Id         string          `json:"id"`
+		Tasks      []*db.Task      `json:"tasks"`
+		OnComplete *db.GroupAction `json:"on_complete"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, "can't parse body json: "+err.Error())
+		return
+	}
+	group := &db.Group{
+		Id:         postData.Id,
+		OnComplete: postData.OnComplete,
+	}
+	ids, ok := h.insertGroup(w, req, group, postData.Tasks)
+	if !ok {
+		return
+	}
+	type OkData struct {
+		Result string   `json:"result"`
+		Id     string   `json:"id"`
+		Tasks  []string `json:"tasks"`
+	}
+	okData, _ := json.Marshal(OkData{"ok", group.Id, ids})
+	w.Write(okData)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskAcquire(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Worker string `json:"worker"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	task, ok := h.acquireTask(w, req, postData.Worker)
+	if !ok {
+		return
+	}
+	type OkData struct {
+		Result string   `json:"result"`
+		Task   *db.Task `json:"task"`
+	}
+	json, _ := json.Marshal(OkData{"ok", task})
+	w.Write(json)
+}
+
+func (h *Handler) taskUpdate(w http.ResponseWriter, r *http.Request, req *request) {
+	state := updateState(r.URL.Path)
+	type PostData struct {
+		Id       string          `json:"id"`
+		Worker   string          `json:"worker"`
+		Error    bool            `json:"error"`
+		Status   string          `json:"status"`
+		Result   json.RawMessage `json:"result"`
+		Progress *db.Progress    `json:"progress"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if state == 3 && postData.Error {
+		state = 4
+	}
+	task, ok := h.updateTask(w, req, postData.Id, postData.Worker, state, postData.Status, postData.Result, postData.Progress)
+	if !ok {
+		return
+	}
+	type OkData struct {
+		Result          string `json:"result"`
+		CancelRequested bool   `json:"cancel_requested,omitempty"`
+	}
+	json, _ := json.Marshal(OkData{"ok", task.CancelRequested})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskCancel(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Id      string `json:"id"`
+		Sticker string `json:"sticker"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if postData.Id != "" && postData.Sticker != "" {
+		h.retErr(w, "only one index posible")
+		return
+	}
+	index, arg := "id", postData.Id
+	if postData.Sticker != "" {
+		if req.tok.scoped() {
+			h.retForbidden(w, "cancel by sticker not allowed for scoped tokens")
+			return
+		}
+		index, arg = "sticker", postData.Sticker
+	} else if postData.Id == "" {
+		h.retErr(w, "index not specified")
+		return
+	} else if !h.checkScope(w, req, postData.Id) {
+		return
+	}
+	cancelled, requested, err := req.db.CancelTasks(index, arg)
+	if err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	type OkData struct {
+		Result          string `json:"result"`
+		Cancelled       int    `json:"cancelled"`
+		CancelRequested int    `json:"cancel_requested"`
+	}
+	json, _ := json.Marshal(OkData{"ok", cancelled, requested})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskResultPurge(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Id      string `json:"id"`
+		Sticker string `json:"sticker"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if postData.Id != "" && postData.Sticker != "" {
+		h.retErr(w, "only one index posible")
+		return
+	}
+	index, arg := "id", postData.Id
+	if postData.Sticker != "" {
+		index, arg = "sticker", postData.Sticker
+	} else if postData.Id == "" {
+		h.retErr(w, "index not specified")
+		return
+	}
+	purged, err := req.db.PurgeResults(index, arg)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	type OkData struct {
+		Result string `json:"result"`
+		Purged int    `json:"purged"`
+	}
+	json, _ := json.Marshal(OkData{"ok", purged})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskEdit(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Id      string `json:"id"`
+		Version uint64 `json:"version"`
+		db.TaskEdit
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	task, ok := h.editTask(w, req, postData.Id, postData.Version, &postData.TaskEdit)
+	if !ok {
+		return
+	}
+	type OkData struct {
+		Result string   `json:"result"`
+		Task   *db.Task `json:"task"`
+	}
+	json, _ := json.Marshal(OkData{"ok", task})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskRequeue(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Id       string `json:"id"`
+		Priority *int   `json:"priority"`
+		Delay    uint64 `json:"delay"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if !h.checkScope(w, req, postData.Id) {
+		return
+	}
+	task, err := req.db.RequeueTask(postData.Id, postData.Priority, postData.Delay)
+	if err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	type OkData struct {
+		Result string   `json:"result"`
+		Task   *db.Task `json:"task"`
+	}
+	json, _ := json.Marshal(OkData{"ok", task})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) taskBulk(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Filter    db.Filter `json:"filter"`
+		BatchSize int       `json:"batch_size"`
+		DryRun    bool      `json:"dry_run"`
+		db.BulkAction
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if postData.Filter.IsEmpty() && !postData.DryRun {
+		h.retErr(w, "empty filter")
+		return
+	}
+	count, err := req.db.BulkUpdate(&postData.Filter, &postData.BulkAction, postData.BatchSize, postData.DryRun)
+	if err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	type OkData struct {
+		Result string `json:"result"`
+		Count  int    `json:"count"`
+		DryRun bool   `json:"dry_run,omitempty"`
+	}
+	json, _ := json.Marshal(OkData{"ok", count, postData.DryRun})
+	w.Write(json)
+	w.Write([]byte("\n"))
+}
+
+func (h *Handler) poolPause(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Pool   string `json:"pool"`
+		Paused bool   `json:"paused"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if !h.pausePool(w, req, postData.Pool, postData.Paused) {
+		return
+	}
+	w.Write([]byte(`{"result":"ok"}` + "\n"))
+}
+
+func (h *Handler) taskDelete(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Id string `json:"id"`
+	}
+	postData := &PostData{}
+	err := json.Unmarshal(req.body, postData)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	task := h.getTask(w, req, postData.Id)
+	if task == nil {
+		return
+	}
+	if err := req.db.DeleteTask(task); err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	w.Write([]byte(`{"result":"ok"}` + "\n"))
+}
+
+// getTask returns the task if it is in the token scope, otherwise it writes
+// the error and returns nil.
+func (h *Handler) getTask(w http.ResponseWriter, req *request, id string) *db.Task {
+	task, err := req.db.GetTask("id", id)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return nil
+	}
+	if task == nil {
+		h.fail(w, req, CodeNotFound, "task not found")
+		return nil
+	}
+	if !req.tok.allows(task) {
+		h.retForbidden(w, "task out of token scope")
+		return nil
+	}
+	return task
+}
+
+func (h *Handler) getPools(req *request) ([]*db.Pool, error) {
+	all, err := req.db.GetPools()
+	if err != nil {
+		return nil, err
+	}
+	pools := []*db.Pool{}
+	for _, p := range all {
+		if req.tok.allowsPool(p.Name) {
+			pools = append(pools, p)
+		}
+	}
+	return pools, nil
+}
+
+// queryTasks runs the query of the url parameters, the tasks out of the
+// token scope are dropped from the page.
+func (h *Handler) queryTasks(r *http.Request, req *request) ([]*db.Task, string, error) {
+	filter, err := db.ParseFilter(r.URL.Query())
+	if err != nil {
+		return nil, "", err
+	}
+	query := &db.Query{
+		Filter: *filter,
+		Order:  r.URL.Query().Get("order"),
+		Limit:  100,
+		Cursor: r.URL.Query().Get("cursor"),
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		query.Limit, err = strconv.Atoi(v)
+		if err != nil || query.Limit <= 0 || query.Limit > 10000 {
+			return nil, "", fmt.Errorf("bad limit: %s", v)
+		}
+	}
+	tasks, cursor, err := req.db.QueryTasks(query)
+	if err != nil {
+		return nil, "", err
+	}
+	if req.tok.scoped() {
+		allowed := []*db.Task{}
+		for _, t := range tasks {
+			if req.tok.allows(t) {
+				allowed = append(allowed, t)
+			}
+		}
+		tasks = allowed
+	}
+	return tasks, cursor, nil
+}
+
+// insertGroup returns the ids of the inserted tasks.
+func (h *Handler) insertGroup(w http.ResponseWriter, req *request, group *db.Group, tasks []*db.Task) ([]string, bool) {
+	if len(tasks) == 0 {
+		h.retErr(w, "no tasks")
+		return nil, false
+	}
+	scope := tasks
+	if group.OnComplete != nil && group.OnComplete.Task != nil {
+		scope = append(scope, group.OnComplete.Task)
+	}
+	for _, t := range scope {
+		if !req.tok.allows(t) {
+			h.retForbidden(w, "task out of token scope")
+			return nil, false
+		}
+	}
+	if err := req.db.InsertGroup(group, tasks); err != nil {
+		h.failErr(w, req, err)
+		return nil, false
+	}
+	ids := make([]string, len(tasks))
+	for i, t := range tasks {
+		ids[i] = t.Id
+	}
+	return ids, true
+}
+
+// acquireTask returns the task acquired for the worker, nil if there is none.
+func (h *Handler) acquireTask(w http.ResponseWriter, req *request, worker string) (*db.Task, bool) {
+	worker, ok := req.tok.workerName(worker)
+	if !ok {
+		h.retForbidden(w, "worker not allowed for the token: "+worker)
+		return nil, false
+	}
+	var allow func(*db.Task) bool
+	if req.tok.scoped() {
+		allow = req.tok.allows
+	}
+	task, err := req.db.AcquireTask(worker, allow)
+	if err != nil {
+		h.failErr(w, req, err)
+		return nil, false
+	}
+	return task, true
+}
+
+// updateState returns the state set by the update, done and refuse routes,
+// done with an error turns into StateError.
+func updateState(path string) int {
+	switch path[strings.LastIndex(path, "/")+1:] {
+	case "done":
+		return db.StateDone
+	case "refuse":
+		return db.StateNew
+	}
+	return db.StateWork
+}
+
+// updateTask applies the report of the worker holding the task and returns
+// the updated task.
+func (h *Handler) updateTask(w http.ResponseWriter, req *request, id string, worker string, state int, status string, result json.RawMessage, progress *db.Progress) (*db.Task, bool) {
+	worker, ok := req.tok.workerName(worker)
+	if !ok {
+		h.retForbidden(w, "worker not allowed for the token: "+worker)
+		return nil, false
+	}
+	task := h.getTask(w, req, id)
+	if task == nil {
+		return nil, false
+	}
+	if task.State == db.StateNew {
+		h.fail(w, req, CodeConflict, "task not acquired")
+		return nil, false
+	}
+	if task.State > db.StateWork {
+		h.fail(w, req, CodeConflict, "task already done")
+		return nil, false
+	}
+	if worker != task.Worker {
+		h.fail(w, req, CodeConflict, "task worker mismatch")
+		return nil, false
+	}
+	task, err := req.db.UpdateTask(task, state, status, result, progress)
+	if err != nil {
+		h.failErr(w, req, err)
+		return nil, false
+	}
+	return task, true
+}
+
+func (h *Handler) editTask(w http.ResponseWriter, req *request, id string, version uint64, e *db.TaskEdit) (*db.Task, bool) {
+	if !h.checkScope(w, req, id) {
+		return nil, false
+	}
+	if e.Pool != nil && !req.tok.allowsPool(*e.Pool) || e.Sticker != nil && !req.tok.allowsSticker(*e.Sticker) {
+		h.retForbidden(w, "task out of token scope")
+		return nil, false
+	}
+	task, err := req.db.EditTask(id, version, e)
+	if err != nil {
+		h.failErr(w, req, err)
+		return nil, false
+	}
+	return task, true
+}
+
+func (h *Handler) pausePool(w http.ResponseWriter, req *request, pool string, paused bool) bool {
+	if pool == "" {
+		h.retErr(w, "pool not specified")
+		return false
+	}
+	if req.tok.scoped() && !req.tok.pools[pool] {
+		// sticker scoped tokens share the pool with others
+		h.retForbidden(w, "pool out of token scope")
+		return false
+	}
+	if err := req.db.PausePool(pool, paused); err != nil {
+		h.failErr(w, req, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,272 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/boiler/ciri/db"
+)
+
+// The v2 routes address the resources by the path and return them as is,
+// without the "result" field of v1. Errors carry the status of their code.
+
+// writeData writes v as the response with the status.
+func (h *Handler) writeData(w http.ResponseWriter, status int, v interface{}) {
+	data, _ := json.Marshal(v)
+	w.WriteHeader(status)
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+// decodeBody parses the json body into v, an empty body leaves v as is.
+func (h *Handler) decodeBody(w http.ResponseWriter, req *request, v interface{}) bool {
+	if len(req.body) == 0 {
+		return true
+	}
+	if err := json.Unmarshal(req.body, v); err != nil {
+		h.retErr(w, "can't parse body json: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func (h *Handler) v2TaskList(w http.ResponseWriter, r *http.Request, req *request) {
+	tasks, cursor, err := h.queryTasks(r, req)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	type OkData struct {
+		Tasks  []*db.Task `json:"tasks"`
+		Cursor string     `json:"cursor,omitempty"`
+	}
+	h.writeData(w, http.StatusOK, OkData{tasks, cursor})
+}
+
+func (h *Handler) v2TaskInsert(w http.ResponseWriter, r *http.Request, req *request) {
+	task := req.db.EmptyTask()
+	if err := json.Unmarshal(req.body, &task); err != nil {
+		h.retErr(w, "can't parse body json: "+err.Error())
+		return
+	}
+	if !req.tok.allows(&task) {
+		h.retForbidden(w, "task out of token scope")
+		return
+	}
+	if err := req.db.InsertTasks([]*db.Task{&task}); err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	w.Header().Set("location", "/v2/tasks/"+task.Id)
+	h.writeData(w, http.StatusCreated, &task)
+}
+
+func (h *Handler) v2TaskGet(w http.ResponseWriter, r *http.Request, req *request) {
+	task := h.getTask(w, req, req.params["id"])
+	if task == nil {
+		return
+	}
+	h.writeData(w, http.StatusOK, task)
+}
+
+func (h *Handler) v2TaskEdit(w http.ResponseWriter, r *http.Request, req *request) {
+	type PatchData struct {
+		Version uint64 `json:"version"`
+		db.TaskEdit
+	}
+	patchData := &PatchData{}
+	if !h.decodeBody(w, req, patchData) {
+		return
+	}
+	task, ok := h.editTask(w, req, req.params["id"], patchData.Version, &patchData.TaskEdit)
+	if !ok {
+		return
+	}
+	h.writeData(w, http.StatusOK, task)
+}
+
+func (h *Handler) v2TaskDelete(w http.ResponseWriter, r *http.Request, req *request) {
+	task := h.getTask(w, req, req.params["id"])
+	if task == nil {
+		return
+	}
+	if err := req.db.DeleteTask(task); err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) v2TaskHistory(w http.ResponseWriter, r *http.Request, req *request) {
+	id := req.params["id"]
+	if !h.checkScope(w, req, id) {
+		return
+	}
+	history, err := req.db.GetHistory(id)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if history == nil {
+		h.fail(w, req, CodeNotFound, "task not found")
+		return
+	}
+	h.writeData(w, http.StatusOK, history)
+}
+
+func (h *Handler) v2TaskDeps(w http.ResponseWriter, r *http.Request, req *request) {
+	id := req.params["id"]
+	if !h.checkScope(w, req, id) {
+		return
+	}
+	nodes, err := req.db.GetTaskGraph(id)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if nodes == nil {
+		h.fail(w, req, CodeNotFound, "task not found")
+		return
+	}
+	type OkData struct {
+		Id    string         `json:"id"`
+		Nodes []*db.TaskNode `json:"nodes"`
+	}
+	h.writeData(w, http.StatusOK, OkData{id, nodes})
+}
+
+func (h *Handler) v2TaskCancel(w http.ResponseWriter, r *http.Request, req *request) {
+	task := h.getTask(w, req, req.params["id"])
+	if task == nil {
+		return
+	}
+	cancelled, requested, err := req.db.CancelTasks("id", task.Id)
+	if err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	type OkData struct {
+		Cancelled       int `json:"cancelled"`
+		CancelRequested int `json:"cancel_requested"`
+	}
+	h.writeData(w, http.StatusOK, OkData{cancelled, requested})
+}
+
+func (h *Handler) v2TaskRequeue(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Priority *int   `json:"priority"`
+		Delay    uint64 `json:"delay"`
+	}
+	postData := &PostData{}
+	if !h.decodeBody(w, req, postData) {
+		return
+	}
+	id := req.params["id"]
+	if !h.checkScope(w, req, id) {
+		return
+	}
+	task, err := req.db.RequeueTask(id, postData.Priority, postData.Delay)
+	if err != nil {
+		h.failErr(w, req, err)
+		return
+	}
+	h.writeData(w, http.StatusOK, task)
+}
+
+func (h *Handler) v2TaskUpdate(w http.ResponseWriter, r *http.Request, req *request) {
+	state := updateState(r.URL.Path)
+	type PostData struct {
+		Worker   string          `json:"worker"`
+		Error    bool            `json:"error"`
+		Status   string          `json:"status"`
+		Result   json.RawMessage `json:"result"`
+		Progress *db.Progress    `json:"progress"`
+	}
+	postData := &PostData{}
+	if !h.decodeBody(w, req, postData) {
+		return
+	}
+	if state == db.StateDone && postData.Error {
+		state = db.StateError
+	}
+	task, ok := h.updateTask(w, req, req.params["id"], postData.Worker, state, postData.Status, postData.Result, postData.Progress)
+	if !ok {
+		return
+	}
+	h.writeData(w, http.StatusOK, task)
+}
+
+// v2TaskAcquire returns 204 when there is no task for the worker.
+func (h *Handler) v2TaskAcquire(w http.ResponseWriter, r *http.Request, req *request) {
+	task, ok := h.acquireTask(w, req, req.params["worker"])
+	if !ok {
+		return
+	}
+	if task == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.writeData(w, http.StatusOK, task)
+}
+
+func (h *Handler) v2GroupInsert(w http.ResponseWriter, r *http.Request, req *request) {
+	type PostData struct {
+		Id         string          `json:"id"`
+		Tasks      []*db.Task      `json:"tasks"`
+		OnComplete *db.GroupAction `json:"on_complete"`
+	}
+	postData := &PostData{}
+	if err := json.Unmarshal(req.body, postData); err != nil {
+		h.retErr(w, "can't parse body json: "+err.Error())
+		return
+	}
+	group := &db.Group{
+		Id:         postData.Id,
+		OnComplete: postData.OnComplete,
+	}
+	ids, ok := h.insertGroup(w, req, group, postData.Tasks)
+	if !ok {
+		return
+	}
+	type OkData struct {
+		Id    string   `json:"id"`
+		Tasks []string `json:"tasks"`
+	}
+	w.Header().Set("location", "/v2/groups/"+group.Id)
+	h.writeData(w, http.StatusCreated, OkData{group.Id, ids})
+}
+
+func (h *Handler) v2GroupGet(w http.ResponseWriter, r *http.Request, req *request) {
+	status, err := req.db.GetGroupStatus(req.params["id"])
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	if status == nil {
+		h.fail(w, req, CodeNotFound, "group not found")
+		return
+	}
+	h.writeData(w, http.StatusOK, status)
+}
+
+func (h *Handler) v2PoolList(w http.ResponseWriter, r *http.Request, req *request) {
+	pools, err := h.getPools(req)
+	if err != nil {
+		h.retErr(w, err.Error())
+		return
+	}
+	type OkData struct {
+		Pools []*db.Pool `json:"pools"`
+	}
+	h.writeData(w, http.StatusOK, OkData{pools})
+}
+
+// v2PoolPause serves both pause and resume.
+func (h *Handler) v2PoolPause(w http.ResponseWriter, r *http.Request, req *request) {
+	paused := strings.HasSuffix(r.URL.Path, "/pause")
+	if !h.pausePool(w, req, req.params["pool"], paused) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -11,13 +11,26 @@ func Init(cfg *config.Config) {
 			Labels:     []string{"sticker", "priority", "pool", "state"},
 		},
 		&PrometheusMetrics{
-			CountNames: []string{"tasks_acquired", "tasks_refused", "tasks_inserted", "tasks_update", "tasks_deleted"},
+			CountNames: []string{"tasks_acquired", "tasks_refused", "tasks_inserted", "tasks_update", "tasks_deleted", "tasks_cancelled"},
 			Labels:     []string{"sticker", "priority", "pool"},
 		},
 		&PrometheusMetrics{
 			CountNames: []string{"tasks_done"},
 			Labels:     []string{"sticker", "priority", "pool", "error"},
 		},
+		&PrometheusMetrics{
+			CountNames: []string{"webhook_deliveries"},
+			Labels:     []string{"result"},
+		},
+		&PrometheusMetrics{
+			GaugeNames: []string{"snapshot_last_success", "snapshot_duration_seconds", "snapshot_size_bytes", "snapshot_tasks"},
+			CountNames: []string{"snapshot_errors"},
+			Labels:     []string{},
+		},
+		&PrometheusMetrics{
+			CountNames: []string{"requests_rejected"},
+			Labels:     []string{"reason", "token"},
+		},
 	}
 	InitPrometheus(cfg, prometheusMetrics)
 }
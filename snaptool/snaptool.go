@@ -0,0 +1,402 @@
+// Package snaptool implements the "ciri snapshot" tool, which reads and
+// writes snapshot files without starting the server.
+package snaptool
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/boiler/ciri/config"
+	"github.com/boiler/ciri/ctl"
+	"github.com/boiler/ciri/db"
+)
+
+const usage = `usage: ciri snapshot <command> [args]
+
+commands:
+  inspect <file>                      print the snapshot summary
+  dump    [filters] [-records] <file> print tasks as NDJSON, all records with -records
+  load    <in.ndjson|-> <out>         write NDJSON tasks or records as a snapshot
+  verify  <file>                      check the snapshot integrity, exit 1 on problems
+
+filters: -state 0,4 -pool p -sticker s -worker w -priority-min n -priority-max n
+         -added-after t -added-before t -updated-after t -updated-before t
+
+Encrypted snapshots are read with the keys of the [encryption] section of the
+server config, load encrypts with its current key.
+`
+
+// keys of the server config, nil without encryption
+var keys *db.Keys
+
+// Main runs the command and returns the process exit code.
+func Main(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	var err error
+	keys, err = db.LoadKeys(config.NewConfig().Encryption)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	switch args[0] {
+	case "inspect":
+		err = inspect(args[1:])
+	case "dump":
+		err = dump(args[1:])
+	case "load":
+		err = load(args[1:])
+	case "verify":
+		var problems []string
+		problems, err = verify(args[1:])
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		if err == nil && len(problems) > 0 {
+			err = fmt.Errorf("%d problems found", len(problems))
+		}
+		if err == nil {
+			fmt.Println("ok")
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		err = fmt.Errorf("unknown command: %s", args[0])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+func decodeFile(path string, fn func(*db.SnapshotRecord) error) (*db.SnapshotInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := keys.Reader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return db.DecodeSnapshot(r, fn)
+}
+
+func fileArg(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("snapshot file required")
+	}
+	return fs.Arg(0), nil
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	path, err := fileArg(fs, args)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	states := make(map[int]int)
+	pools := make(map[string]int)
+	var oldest, newest uint64
+	info, err := decodeFile(path, func(rec *db.SnapshotRecord) error {
+		switch {
+		case rec.Task != nil:
+			t := rec.Task
+			counts["tasks"]++
+			states[t.State]++
+			pools[t.Pool]++
+			if oldest == 0 || t.Added < oldest {
+				oldest = t.Added
+			}
+			if t.Updated > newest {
+				newest = t.Updated
+			}
+		case rec.Group != nil:
+			counts["groups"]++
+		case rec.History != nil:
+			counts["histories"]++
+		case rec.Pool != nil:
+			counts["pools"]++
+		case rec.Member != nil:
+			counts["members"]++
+		}
+		return nil
+	})
+	if info == nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "version:\t%d\n", info.Version)
+	fmt.Fprintf(tw, "records:\t%d\n", info.Records)
+	fmt.Fprintf(tw, "ended:\t%v\n", info.Ended)
+	for _, name := range []string{"tasks", "groups", "histories", "pools", "members"} {
+		fmt.Fprintf(tw, "%s:\t%d\n", name, counts[name])
+	}
+	if counts["tasks"] > 0 {
+		fmt.Fprintf(tw, "added from:\t%s\n", ctl.FormatTime(oldest))
+		fmt.Fprintf(tw, "updated to:\t%s\n", ctl.FormatTime(newest))
+	}
+	tw.Flush()
+
+	if len(states) > 0 {
+		fmt.Println()
+		tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "STATE\tTASKS")
+		keys := []int{}
+		for s := range states {
+			keys = append(keys, s)
+		}
+		sort.Ints(keys)
+		for _, s := range keys {
+			fmt.Fprintf(tw, "%s\t%d\n", ctl.StateName(s), states[s])
+		}
+		tw.Flush()
+	}
+	if len(pools) > 0 {
+		fmt.Println()
+		tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "POOL\tTASKS")
+		keys := []string{}
+		for p := range pools {
+			keys = append(keys, p)
+		}
+		sort.Strings(keys)
+		for _, p := range keys {
+			fmt.Fprintf(tw, "%s\t%d\n", p, pools[p])
+		}
+		tw.Flush()
+	}
+	return err
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	filter := ctl.AddFilterFlags(fs)
+	records := fs.Bool("records", false, "dump all records, not only tasks")
+	path, err := fileArg(fs, args)
+	if err != nil {
+		return err
+	}
+	f, err := filter()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+	_, err = decodeFile(path, func(rec *db.SnapshotRecord) error {
+		if rec.Task != nil && !f.Match(rec.Task) {
+			return nil
+		}
+		if *records {
+			return enc.Encode(rec)
+		}
+		if rec.Task != nil {
+			return enc.Encode(rec.Task)
+		}
+		return nil
+	})
+	return err
+}
+
+// load reads NDJSON lines of either tasks, as written by dump, or records,
+// as written by dump -records.
+func load(args []string) error {
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("input and output files required")
+	}
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	out := fs.Arg(1)
+	f, err := os.Create(out + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out + ".tmp")
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	ew, err := keys.Writer(w)
+	if err != nil {
+		return err
+	}
+	sw, err := db.NewSnapshotWriter(ew)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 64<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec, err := parseLine(scanner.Bytes())
+		if err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+		if rec.End != nil {
+			continue
+		}
+		var key string
+		switch {
+		case rec.Task != nil:
+			if rec.Task.Id == "" {
+				return fmt.Errorf("line %d: task id required", line)
+			}
+			key = "task " + rec.Task.Id
+		case rec.Group != nil:
+			key = "group " + rec.Group.Id
+		case rec.History != nil:
+			key = "history " + rec.History.Id
+		case rec.Pool != nil:
+			key = "pool " + rec.Pool.Name
+		case rec.Member != nil:
+			key = "member " + rec.Member.Id
+		}
+		if seen[key] {
+			return fmt.Errorf("line %d: duplicate %s", line, key)
+		}
+		seen[key] = true
+		if err := sw.Write(rec); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	if err := ew.Close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out+".tmp", out)
+}
+
+// parseLine decodes a record line, which has a single record key with an
+// object value, or a task line otherwise. Tasks have a "pool" key too, so the
+// value type tells them apart.
+func parseLine(line []byte) (*db.SnapshotRecord, error) {
+	rec := &db.SnapshotRecord{}
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(line, &keys); err != nil {
+		return nil, err
+	}
+	if len(keys) == 1 {
+		for key, v := range keys {
+			switch key {
+			case "task", "group", "history", "pool", "member", "end":
+				if len(v) > 0 && v[0] == '{' {
+					return rec, json.Unmarshal(line, rec)
+				}
+			}
+		}
+	}
+	rec.Task = &db.Task{}
+	return rec, json.Unmarshal(line, rec.Task)
+}
+
+// verify returns the integrity problems found, err is set when the snapshot
+// can't be read at all.
+func verify(args []string) ([]string, error) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	path, err := fileArg(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	problems := []string{}
+	tasks := make(map[string]*db.Task)
+	groups := make(map[string]bool)
+	seen := make(map[string]bool)
+	dup := func(key string) {
+		if seen[key] {
+			problems = append(problems, "duplicate "+key)
+		}
+		seen[key] = true
+	}
+	info, err := decodeFile(path, func(rec *db.SnapshotRecord) error {
+		switch {
+		case rec.Task != nil:
+			dup("task " + rec.Task.Id)
+			tasks[rec.Task.Id] = rec.Task
+		case rec.Group != nil:
+			dup("group " + rec.Group.Id)
+			groups[rec.Group.Id] = true
+		case rec.History != nil:
+			dup("history " + rec.History.Id)
+		case rec.Pool != nil:
+			dup("pool " + rec.Pool.Name)
+		case rec.Member != nil:
+			dup("member " + rec.Member.Id)
+		default:
+			problems = append(problems, "empty record")
+		}
+		return nil
+	})
+	if info == nil {
+		return nil, err
+	}
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if info.Version >= 3 && !info.Ended && err == nil {
+		problems = append(problems, "end record missing")
+	}
+
+	ids := []string{}
+	for id := range tasks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		t := tasks[id]
+		if id == "" {
+			problems = append(problems, "task with empty id")
+		}
+		if t.State < db.StateNew || t.State > db.StateBlocked {
+			problems = append(problems, fmt.Sprintf("task %s: bad state %d", id, t.State))
+		}
+		for _, dep := range t.DependsOn {
+			if _, ok := tasks[dep]; !ok && t.State == db.StateBlocked {
+				problems = append(problems, fmt.Sprintf("task %s: blocked on missing dependency %s", id, dep))
+			}
+		}
+		if t.Group != "" && !groups[t.Group] {
+			problems = append(problems, fmt.Sprintf("task %s: group %s not found", id, t.Group))
+		}
+	}
+	return problems, nil
+}
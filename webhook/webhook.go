@@ -0,0 +1,253 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boiler/ciri/config"
+	"github.com/boiler/ciri/db"
+	"github.com/boiler/ciri/metrics"
+)
+
+type Delivery struct {
+	Id         uint64 `json:"id"`
+	Url        string `json:"url"`
+	EventId    uint64 `json:"event_id"`
+	EventType  string `json:"event_type"`
+	TaskId     string `json:"task_id,omitempty"`
+	GroupId    string `json:"group_id,omitempty"`
+	Attempts   int    `json:"attempts"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Delivered  bool   `json:"delivered"`
+	Time       uint64 `json:"time"`
+}
+
+type subscription struct {
+	cfg      *config.ConfigWebhook
+	events   map[string]bool
+	pools    map[string]bool
+	stickers map[string]bool
+	queue    chan *db.Event
+}
+
+// Dispatcher posts task events to the configured webhooks, and the
+// group_complete events to the webhook of the group. Every webhook has its
+// own queue, so a slow receiver does not delay the others.
+type Dispatcher struct {
+	cfg    *config.Config
+	events *db.EventLog
+	subs   []*subscription
+	client *http.Client
+	active func() bool
+
+	mutex   sync.Mutex
+	log     []*Delivery
+	nextId  uint64
+	logSize int
+}
+
+func New(cfg *config.Config, events *db.EventLog) *Dispatcher {
+	d := &Dispatcher{
+		cfg:     cfg,
+		events:  events,
+		client:  &http.Client{Timeout: time.Duration(cfg.WebhookTimeout) * time.Second},
+		logSize: cfg.WebhookLogSize,
+	}
+	set := func(l []string) map[string]bool {
+		m := make(map[string]bool)
+		for _, v := range l {
+			m[v] = true
+		}
+		return m
+	}
+	for _, wh := range cfg.Webhook {
+		d.subs = append(d.subs, &subscription{
+			cfg:      wh,
+			events:   set(wh.Events),
+			pools:    set(wh.Pools),
+			stickers: set(wh.Stickers),
+			queue:    make(chan *db.Event, cfg.WebhookQueueSize),
+		})
+	}
+	return d
+}
+
+// SetActive makes the dispatcher deliver only while active returns true, e.g.
+// on the cluster leader, as every node publishes the events.
+func (d *Dispatcher) SetActive(active func() bool) {
+	d.active = active
+}
+
+func (s *subscription) match(e *db.Event) bool {
+	if e.Group != nil {
+		return e.Webhook == s.cfg.Url
+	}
+	if len(s.events) > 0 && !s.events[e.Type] {
+		return false
+	}
+	if len(s.pools) > 0 && !s.pools[e.Task.Pool] {
+		return false
+	}
+	if len(s.stickers) > 0 && !s.stickers[e.Task.Sticker] {
+		return false
+	}
+	return true
+}
+
+// Run reads the event log and feeds the webhook queues until done is closed.
+func (d *Dispatcher) Run(done chan struct{}) {
+	if len(d.subs) == 0 {
+		return
+	}
+	for _, s := range d.subs {
+		go d.deliverLoop(s, done)
+	}
+	ch, cancel := d.events.Subscribe()
+	defer cancel()
+	last := d.events.LastId()
+	for {
+		events, overflow := d.events.Since(last)
+		if overflow {
+			log.Print("webhook: event log overflow, events skipped")
+		}
+		for _, e := range events {
+			last = e.Id
+			if d.active != nil && !d.active() {
+				continue
+			}
+			for _, s := range d.subs {
+				if !s.match(e) {
+					continue
+				}
+				select {
+				case s.queue <- e:
+				default:
+					log.Printf("webhook %s: queue full, event %d dropped", s.cfg.Url, e.Id)
+					metrics.CountAdd("webhook_deliveries", 1, "dropped")
+				}
+			}
+		}
+		select {
+		case <-ch:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliverLoop(s *subscription, done chan struct{}) {
+	for {
+		select {
+		case e := <-s.queue:
+			d.deliver(s, e, done)
+		case <-done:
+			return
+		}
+	}
+}
+
+// deliver posts the event retrying with exponential backoff.
+func (d *Dispatcher) deliver(s *subscription, e *db.Event, done chan struct{}) {
+	body, _ := json.Marshal(e)
+	delivery := d.newDelivery(s.cfg.Url, e)
+	backoff := time.Duration(d.cfg.WebhookBackoff) * time.Second
+	for {
+		code, err := d.post(s.cfg, delivery.Id, e, body)
+		d.mutex.Lock()
+		delivery.Attempts++
+		delivery.StatusCode = code
+		delivery.Time = uint64(time.Now().Unix())
+		delivery.Error = ""
+		if err != nil {
+			delivery.Error = err.Error()
+		} else {
+			delivery.Delivered = true
+		}
+		attempts := delivery.Attempts
+		d.mutex.Unlock()
+
+		if err == nil {
+			metrics.CountAdd("webhook_deliveries", 1, "delivered")
+			return
+		}
+		log.Printf("webhook %s: event %d: attempt %d: %s", s.cfg.Url, e.Id, attempts, err)
+		if attempts >= d.cfg.WebhookMaxAttempts {
+			metrics.CountAdd("webhook_deliveries", 1, "failed")
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-done:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+func (d *Dispatcher) post(wh *config.ConfigWebhook, deliveryId uint64, e *db.Event, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, wh.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("x-ciri-event", e.Type)
+	req.Header.Set("x-ciri-delivery", strconv.FormatUint(deliveryId, 10))
+	if wh.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.Secret))
+		mac.Write(body)
+		req.Header.Set("x-ciri-signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) newDelivery(url string, e *db.Event) *Delivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.nextId++
+	delivery := &Delivery{
+		Id:        d.nextId,
+		Url:       url,
+		EventId:   e.Id,
+		EventType: e.Type,
+		Time:      uint64(time.Now().Unix()),
+	}
+	if e.Task != nil {
+		delivery.TaskId = e.Task.Id
+	} else if e.Group != nil {
+		delivery.GroupId = e.Group.Id
+	}
+	d.log = append(d.log, delivery)
+	if len(d.log) > d.logSize {
+		d.log = d.log[len(d.log)-d.logSize:]
+	}
+	return delivery
+}
+
+// Deliveries returns copies of the latest deliveries, newest first.
+func (d *Dispatcher) Deliveries() []Delivery {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	res := make([]Delivery, 0, len(d.log))
+	for i := len(d.log) - 1; i >= 0; i-- {
+		res = append(res, *d.log[i])
+	}
+	return res
+}
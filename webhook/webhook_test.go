@@ -0,0 +1,292 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boiler/ciri/config"
+	"github.com/boiler/ciri/db"
+)
+
+type received struct {
+	event     string
+	signature string
+	body      []byte
+	time      time.Time
+}
+
+// receiver is a local webhook endpoint answering with status(n) to the n-th
+// request, counted from 1.
+type receiver struct {
+	*httptest.Server
+	status func(n int) int
+
+	mutex    sync.Mutex
+	requests []received
+	notify   chan struct{}
+}
+
+func newReceiver(t *testing.T, status func(n int) int) *receiver {
+	rc := &receiver{status: status, notify: make(chan struct{}, 100)}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rc.mutex.Lock()
+		rc.requests = append(rc.requests, received{
+			event:     r.Header.Get("x-ciri-event"),
+			signature: r.Header.Get("x-ciri-signature"),
+			body:      body,
+			time:      time.Now(),
+		})
+		n := len(rc.requests)
+		rc.mutex.Unlock()
+		w.WriteHeader(rc.status(n))
+		rc.notify <- struct{}{}
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+// wait returns the requests once there are n of them.
+func (rc *receiver) wait(t *testing.T, n int) []received {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		rc.mutex.Lock()
+		if len(rc.requests) >= n {
+			res := append([]received{}, rc.requests...)
+			rc.mutex.Unlock()
+			return res
+		}
+		rc.mutex.Unlock()
+		select {
+		case <-rc.notify:
+		case <-timeout:
+			t.Fatalf("timeout waiting for %d requests", n)
+		}
+	}
+}
+
+func (rc *receiver) count() int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return len(rc.requests)
+}
+
+func ok(int) int { return http.StatusOK }
+
+func newTestConfig(hooks ...*config.ConfigWebhook) *config.Config {
+	return &config.Config{
+		DefaultPoolMaxSize:       8,
+		DefaultPoolMaxResultSize: 65536,
+		EventBufferSize:          1024,
+		WebhookTimeout:           5,
+		WebhookMaxAttempts:       3,
+		WebhookQueueSize:         100,
+		WebhookLogSize:           100,
+		Webhook:                  hooks,
+	}
+}
+
+// start runs the dispatcher of cfg on a new db until the test ends.
+func start(t *testing.T, cfg *config.Config) (*db.DB, *Dispatcher) {
+	t.Helper()
+	mdb, err := db.NewDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := New(cfg, mdb.Events())
+	done := make(chan struct{})
+	go d.Run(done)
+	t.Cleanup(func() { close(done) })
+	time.Sleep(10 * time.Millisecond) // let Run take the last event id
+	return mdb, d
+}
+
+func insert(t *testing.T, mdb *db.DB, id string, pool string, sticker string) {
+	t.Helper()
+	task := mdb.EmptyTask()
+	task.Id, task.Pool, task.Sticker = id, pool, sticker
+	if err := mdb.InsertTasks([]*db.Task{&task}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	rc := newReceiver(t, ok)
+	mdb, d := start(t, newTestConfig(&config.ConfigWebhook{Url: rc.URL}))
+
+	insert(t, mdb, "t1", "", "")
+	req := rc.wait(t, 1)[0]
+	if req.event != "insert" {
+		t.Errorf("x-ciri-event %q, expected insert", req.event)
+	}
+	if req.signature != "" {
+		t.Errorf("signature %q without a secret", req.signature)
+	}
+	e := &db.Event{}
+	if err := json.Unmarshal(req.body, e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "insert" || e.Task == nil || e.Task.Id != "t1" {
+		t.Errorf("unexpected event: %s", req.body)
+	}
+
+	time.Sleep(50 * time.Millisecond) // the delivery is logged after the response
+	deliveries := d.Deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries, expected 1", len(deliveries))
+	}
+	if dl := deliveries[0]; !dl.Delivered || dl.Attempts != 1 || dl.StatusCode != 200 || dl.TaskId != "t1" {
+		t.Errorf("unexpected delivery: %+v", dl)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	rc := newReceiver(t, ok)
+	mdb, _ := start(t, newTestConfig(&config.ConfigWebhook{Url: rc.URL, Secret: "secret"}))
+
+	insert(t, mdb, "t1", "", "")
+	req := rc.wait(t, 1)[0]
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(req.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if req.signature != expected {
+		t.Errorf("signature %q, expected %q", req.signature, expected)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	// fails twice, the third attempt succeeds
+	rc := newReceiver(t, func(n int) int {
+		if n < 3 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusOK
+	})
+	mdb, d := start(t, newTestConfig(&config.ConfigWebhook{Url: rc.URL}))
+
+	insert(t, mdb, "t1", "", "")
+	reqs := rc.wait(t, 3)
+	for _, req := range reqs {
+		e := &db.Event{}
+		json.Unmarshal(req.body, e)
+		if e.Task == nil || e.Task.Id != "t1" {
+			t.Errorf("unexpected event: %s", req.body)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	dl := d.Deliveries()[0]
+	if !dl.Delivered || dl.Attempts != 3 || dl.StatusCode != 200 || dl.Error != "" {
+		t.Errorf("unexpected delivery: %+v", dl)
+	}
+}
+
+func TestBackoffAndMaxAttempts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the backoff")
+	}
+	rc := newReceiver(t, func(int) int { return http.StatusServiceUnavailable })
+	cfg := newTestConfig(&config.ConfigWebhook{Url: rc.URL})
+	cfg.WebhookBackoff = 1
+	mdb, d := start(t, cfg)
+
+	insert(t, mdb, "t1", "", "")
+	reqs := rc.wait(t, 3)
+	// the backoff doubles: 1s, 2s
+	for i, min := range []time.Duration{time.Second, 2 * time.Second} {
+		if gap := reqs[i+1].time.Sub(reqs[i].time); gap < min {
+			t.Errorf("attempt %d after %s, expected at least %s", i+2, gap, min)
+		}
+	}
+	time.Sleep(4500 * time.Millisecond) // a 4th attempt would be due after 4s
+	if n := rc.count(); n != 3 {
+		t.Errorf("%d attempts, expected webhook_max_attempts 3", n)
+	}
+	dl := d.Deliveries()[0]
+	if dl.Delivered || dl.Attempts != 3 || dl.StatusCode != http.StatusServiceUnavailable || dl.Error == "" {
+		t.Errorf("unexpected delivery: %+v", dl)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	matching := newReceiver(t, ok)
+	other := newReceiver(t, ok)
+	mdb, _ := start(t, newTestConfig(
+		&config.ConfigWebhook{Url: matching.URL, Events: []string{"insert"}, Pools: []string{"p1"}, Stickers: []string{"s1"}},
+		&config.ConfigWebhook{Url: other.URL, Events: []string{"cancel"}},
+	))
+
+	insert(t, mdb, "pool", "p2", "s1")
+	insert(t, mdb, "sticker", "p1", "s2")
+	insert(t, mdb, "match", "p1", "s1")
+	if _, _, err := mdb.CancelTasks("id", "match"); err != nil {
+		t.Fatal(err)
+	}
+	// the queue of a webhook is ordered, so the filtered events would have
+	// arrived before the matching ones
+	for _, tc := range []struct {
+		rc    *receiver
+		event string
+	}{
+		{matching, "insert"},
+		{other, "cancel"},
+	} {
+		reqs := tc.rc.wait(t, 1)
+		time.Sleep(50 * time.Millisecond)
+		if n := tc.rc.count(); n != 1 {
+			t.Errorf("%d requests, expected 1", n)
+		}
+		e := &db.Event{}
+		json.Unmarshal(reqs[0].body, e)
+		if e.Type != tc.event || e.Task == nil || e.Task.Id != "match" {
+			t.Errorf("unexpected event: %s", reqs[0].body)
+		}
+	}
+}
+
+func TestGroupComplete(t *testing.T) {
+	group := newReceiver(t, ok)
+	all := newReceiver(t, ok)
+	mdb, _ := start(t, newTestConfig(
+		&config.ConfigWebhook{Url: group.URL, Events: []string{"cancel"}},
+		&config.ConfigWebhook{Url: all.URL, Events: []string{"cancel"}},
+	))
+
+	task := mdb.EmptyTask()
+	task.Id = "t1"
+	g := &db.Group{Id: "g1", OnComplete: &db.GroupAction{Webhook: group.URL}}
+	if err := mdb.InsertGroup(g, []*db.Task{&task}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mdb.CancelTasks("id", "t1"); err != nil {
+		t.Fatal(err)
+	}
+	reqs := group.wait(t, 2)
+	if reqs[1].event != "group_complete" {
+		t.Fatalf("x-ciri-event %q, expected group_complete", reqs[1].event)
+	}
+	e := &db.Event{}
+	json.Unmarshal(reqs[1].body, e)
+	if e.Group == nil || e.Group.Id != "g1" || e.Group.Finished != 1 {
+		t.Errorf("unexpected event: %s", reqs[1].body)
+	}
+	// only the webhook of the group gets the event
+	all.wait(t, 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := all.count(); n != 1 {
+		t.Errorf("%d requests to the other webhook, expected 1", n)
+	}
+
+	g2 := &db.Group{Id: "g2", OnComplete: &db.GroupAction{Webhook: "http://169.254.169.254/"}}
+	if err := mdb.InsertGroup(g2, []*db.Task{}); err == nil {
+		t.Error("group webhook not in the config accepted")
+	}
+}